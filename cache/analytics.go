@@ -0,0 +1,321 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	"github.com/patcharp/go_swth/server"
+	"strconv"
+	"time"
+)
+
+// Leaderboard ranks members by score, highest score first, on a sorted set.
+type Leaderboard struct {
+	r    *Redis
+	name string
+}
+
+type LeaderboardEntry struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+	// Rank starts at 1 for the highest score.
+	Rank int64 `json:"rank"`
+}
+
+func NewLeaderboard(r *Redis, name string) *Leaderboard {
+	return &Leaderboard{r: r, name: name}
+}
+
+func (b *Leaderboard) Add(member string, score float64) error {
+	return b.r.Client.ZAdd(b.key(), &redis.Z{Score: score, Member: member}).Err()
+}
+
+// Incr adds by to the score of member and returns the new score.
+func (b *Leaderboard) Incr(member string, by float64) (float64, error) {
+	return b.r.Client.ZIncrBy(b.key(), by, member).Result()
+}
+
+func (b *Leaderboard) Remove(members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	m := make([]interface{}, len(members))
+	for i, member := range members {
+		m[i] = member
+	}
+	return b.r.Client.ZRem(b.key(), m...).Err()
+}
+
+// Rank returns the entry of member, redis.Nil when it is not ranked.
+func (b *Leaderboard) Rank(member string) (LeaderboardEntry, error) {
+	entry := LeaderboardEntry{Member: member}
+	pipe := b.r.Client.Pipeline()
+	rank := pipe.ZRevRank(b.key(), member)
+	score := pipe.ZScore(b.key(), member)
+	if _, err := pipe.Exec(); err != nil {
+		return entry, err
+	}
+	entry.Rank = rank.Val() + 1
+	entry.Score = score.Val()
+	return entry, nil
+}
+
+func (b *Leaderboard) Count() (int64, error) {
+	return b.r.Client.ZCard(b.key()).Result()
+}
+
+func (b *Leaderboard) Top(n int64) ([]LeaderboardEntry, error) {
+	return b.Range(0, n)
+}
+
+// Range returns count entries starting at offset, 0 is the top entry.
+func (b *Leaderboard) Range(offset int64, count int64) ([]LeaderboardEntry, error) {
+	if count <= 0 {
+		return []LeaderboardEntry{}, nil
+	}
+	z, err := b.r.Client.ZRevRangeWithScores(b.key(), offset, offset+count-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LeaderboardEntry, len(z))
+	for i, item := range z {
+		entries[i] = LeaderboardEntry{
+			Member: fmt.Sprint(item.Member),
+			Score:  item.Score,
+			Rank:   offset + int64(i) + 1,
+		}
+	}
+	return entries, nil
+}
+
+// Page returns the entries of page p and the total number of members.
+func (b *Leaderboard) Page(p server.Pagination) ([]LeaderboardEntry, int64, error) {
+	total, err := b.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+	entries, err := b.Range(int64(p.Offset()), int64(p.Size))
+	return entries, total, err
+}
+
+func (b *Leaderboard) Reset() error {
+	return b.r.Client.Del(b.key()).Err()
+}
+
+func (b *Leaderboard) key() string {
+	return b.r.Key(fmt.Sprintf("leaderboard:%s", b.name), nil)
+}
+
+// Resolution is the bucket size of a Counter and how long buckets are kept.
+type Resolution struct {
+	Name      string
+	Size      time.Duration
+	Retention time.Duration
+}
+
+var (
+	Minute = Resolution{Name: "m", Size: time.Minute, Retention: 48 * time.Hour}
+	Hour   = Resolution{Name: "h", Size: time.Hour, Retention: 60 * 24 * time.Hour}
+	Day    = Resolution{Name: "d", Size: 24 * time.Hour, Retention: 2 * 365 * 24 * time.Hour}
+)
+
+type CounterPoint struct {
+	Time  time.Time `json:"time"`
+	Count int64     `json:"count"`
+}
+
+// Counter counts events in time buckets. Every increment is rolled up into
+// all resolutions at once so reads never aggregate smaller buckets.
+type Counter struct {
+	r           *Redis
+	name        string
+	Resolutions []Resolution
+	// Location defines where day buckets start, default is time.Local.
+	Location *time.Location
+}
+
+func NewCounter(r *Redis, name string) *Counter {
+	return &Counter{
+		r:           r,
+		name:        name,
+		Resolutions: []Resolution{Minute, Hour, Day},
+		Location:    time.Local,
+	}
+}
+
+func (c *Counter) Incr(t time.Time, by int64) error {
+	_, err := c.r.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, res := range c.Resolutions {
+			key := c.key(res, t)
+			pipe.IncrBy(key, by)
+			pipe.Expire(key, res.Retention)
+		}
+		return nil
+	})
+	return err
+}
+
+func (c *Counter) Get(res Resolution, t time.Time) (int64, error) {
+	n, err := c.r.Client.Get(c.key(res, t)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+// Range returns one point per bucket of res from from until to, both
+// included, with empty buckets reported as 0.
+func (c *Counter) Range(res Resolution, from time.Time, to time.Time) ([]CounterPoint, error) {
+	var points []CounterPoint
+	var keys []string
+	for t := c.bucket(res, from); !t.After(to); t = c.next(res, t) {
+		points = append(points, CounterPoint{Time: t})
+		keys = append(keys, c.key(res, t))
+	}
+	if len(keys) == 0 {
+		return points, nil
+	}
+	values, err := c.r.Client.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			points[i].Count, _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+	return points, nil
+}
+
+// Sum returns the total of the buckets of res between from and to.
+func (c *Counter) Sum(res Resolution, from time.Time, to time.Time) (int64, error) {
+	points, err := c.Range(res, from, to)
+	if err != nil {
+		return 0, err
+	}
+	var sum int64
+	for _, p := range points {
+		sum += p.Count
+	}
+	return sum, nil
+}
+
+func (c *Counter) bucket(res Resolution, t time.Time) time.Time {
+	t = t.In(c.location())
+	if res.Size%(24*time.Hour) == 0 {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+	return t.Truncate(res.Size)
+}
+
+func (c *Counter) next(res Resolution, t time.Time) time.Time {
+	if res.Size%(24*time.Hour) == 0 {
+		return t.AddDate(0, 0, int(res.Size/(24*time.Hour)))
+	}
+	return t.Add(res.Size)
+}
+
+func (c *Counter) location() *time.Location {
+	if c.Location == nil {
+		return time.Local
+	}
+	return c.Location
+}
+
+func (c *Counter) key(res Resolution, t time.Time) string {
+	return c.r.Key(fmt.Sprintf("counter:%s:%s:%d", c.name, res.Name, c.bucket(res, t).Unix()), nil)
+}
+
+// UniqueCounter estimates distinct members per day with HyperLogLog.
+type UniqueCounter struct {
+	r         *Redis
+	name      string
+	Retention time.Duration
+	Location  *time.Location
+}
+
+func NewUniqueCounter(r *Redis, name string) *UniqueCounter {
+	return &UniqueCounter{
+		r:         r,
+		name:      name,
+		Retention: Day.Retention,
+		Location:  time.Local,
+	}
+}
+
+func (u *UniqueCounter) Add(t time.Time, members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	m := make([]interface{}, len(members))
+	for i, member := range members {
+		m[i] = member
+	}
+	key := u.key(t)
+	_, err := u.r.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.PFAdd(key, m...)
+		pipe.Expire(key, u.Retention)
+		return nil
+	})
+	return err
+}
+
+func (u *UniqueCounter) Count(day time.Time) (int64, error) {
+	return u.r.Client.PFCount(u.key(day)).Result()
+}
+
+// CountRange estimates the distinct members over all days from from to to,
+// a member seen on several days is counted once.
+func (u *UniqueCounter) CountRange(from time.Time, to time.Time) (int64, error) {
+	keys := u.keys(from, to)
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	return u.r.Client.PFCount(keys...).Result()
+}
+
+// Merge stores the union of the days from from to to under dest, for
+// example a weekly or monthly unique counter, and returns its estimate.
+func (u *UniqueCounter) Merge(dest string, from time.Time, to time.Time, timeout time.Duration) (int64, error) {
+	keys := u.keys(from, to)
+	destKey := u.r.Key(fmt.Sprintf("unique:%s:%s", u.name, dest), nil)
+	pipe := u.r.Client.TxPipeline()
+	pipe.Del(destKey)
+	if len(keys) > 0 {
+		pipe.PFMerge(destKey, keys...)
+	}
+	count := pipe.PFCount(destKey)
+	if timeout > 0 {
+		pipe.Expire(destKey, timeout)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+// CountMerged returns the estimate of a counter created by Merge.
+func (u *UniqueCounter) CountMerged(dest string) (int64, error) {
+	return u.r.Client.PFCount(u.r.Key(fmt.Sprintf("unique:%s:%s", u.name, dest), nil)).Result()
+}
+
+func (u *UniqueCounter) keys(from time.Time, to time.Time) []string {
+	var keys []string
+	loc := u.location()
+	from, to = from.In(loc), to.In(loc)
+	day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+	for ; !day.After(to); day = day.AddDate(0, 0, 1) {
+		keys = append(keys, u.key(day))
+	}
+	return keys
+}
+
+func (u *UniqueCounter) location() *time.Location {
+	if u.Location == nil {
+		return time.Local
+	}
+	return u.Location
+}
+
+func (u *UniqueCounter) key(t time.Time) string {
+	return u.r.Key(fmt.Sprintf("unique:%s:%s", u.name, t.In(u.location()).Format("20060102")), nil)
+}
@@ -0,0 +1,267 @@
+package cache
+
+import (
+	"errors"
+	"github.com/go-redis/redis/v7"
+	"reflect"
+	"time"
+)
+
+const DefaultUpdateRetries = 10
+
+var ErrUpdateConflict = errors.New("cache update conflict, too many retries")
+
+type Item struct {
+	Key   string
+	Value interface{}
+	TTL   time.Duration
+}
+
+var incrScript = redis.NewScript(`
+local v = redis.call('INCRBY', KEYS[1], ARGV[1])
+local ttl = tonumber(ARGV[2])
+if ttl > 0 and redis.call('PTTL', KEYS[1]) == -1 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return v
+`)
+
+var getSetScript = redis.NewScript(`
+local old = redis.call('GET', KEYS[1])
+local ttl = tonumber(ARGV[2])
+if ttl > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ttl)
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return old
+`)
+
+var compareAndSwapScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current ~= ARGV[1] then
+	return 0
+end
+local ttl = tonumber(ARGV[3])
+if ttl <= 0 then
+	ttl = redis.call('PTTL', KEYS[1])
+end
+if ttl > 0 then
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ttl)
+else
+	redis.call('SET', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// MGet loads keys in one round-trip. dest must be a pointer to a slice, the
+// found values are appended in key order, or a pointer to a map keyed by
+// string. The keys which were not found are returned.
+func (r *Redis) MGet(keys []string, dest interface{}) (missing []string, err error) {
+	start := time.Now()
+	dv := reflect.ValueOf(dest)
+	if dv.Kind() != reflect.Ptr || dv.IsNil() {
+		return nil, errors.New("mget destination must be a non-nil pointer")
+	}
+	dv = dv.Elem()
+	switch dv.Kind() {
+	case reflect.Slice:
+	case reflect.Map:
+		if dv.Type().Key().Kind() != reflect.String {
+			return nil, errors.New("mget destination map must be keyed by string")
+		}
+		if dv.IsNil() {
+			dv.Set(reflect.MakeMap(dv.Type()))
+		}
+	default:
+		return nil, errors.New("mget destination must be a slice or a map")
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	elemType := dv.Type().Elem()
+	like := reflect.New(elemType).Interface()
+	redisKeys := make([]string, len(keys))
+	for i, key := range keys {
+		redisKeys[i] = r.Key(key, like)
+	}
+	defer func() {
+		r.observe("mget", "", start, len(keys)-len(missing), len(missing), &err)
+	}()
+	values, err := r.Client.MGet(redisKeys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		s, ok := values[i].(string)
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+		elem := reflect.New(elemType)
+		if err := decodeValue([]byte(s), elem.Interface()); err != nil {
+			return missing, err
+		}
+		if dv.Kind() == reflect.Slice {
+			dv.Set(reflect.Append(dv, elem.Elem()))
+		} else {
+			dv.SetMapIndex(reflect.ValueOf(key).Convert(dv.Type().Key()), elem.Elem())
+		}
+	}
+	return missing, nil
+}
+
+// MSet stores every item with its own TTL through a single pipeline.
+func (r *Redis) MSet(items ...Item) (err error) {
+	defer r.observe("mset", "", time.Now(), 0, 0, &err)
+	if len(items) == 0 {
+		return nil
+	}
+	encoded := make([][]byte, len(items))
+	for i, item := range items {
+		b, err := encodeValue(r.codec(), item.Value)
+		if err != nil {
+			return err
+		}
+		encoded[i] = b
+	}
+	_, err = r.Client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, item := range items {
+			pipe.Set(r.Key(item.Key, item.Value), encoded[i], item.TTL)
+		}
+		return nil
+	})
+	return err
+}
+
+// Incr increments the counter at key by n. The TTL is applied when the key
+// is created, a timeout of 0 keeps the key forever.
+func (r *Redis) Incr(key string, n int64, timeout time.Duration) (v int64, err error) {
+	defer r.observe("incr", key, time.Now(), 0, 0, &err)
+	return incrScript.Run(r.Client, []string{r.Key(key, nil)}, n, ms(timeout)).Int64()
+}
+
+func (r *Redis) Decr(key string, n int64, timeout time.Duration) (int64, error) {
+	return r.Incr(key, -n, timeout)
+}
+
+// SetNX stores v only when key does not exist yet and reports whether it did.
+func (r *Redis) SetNX(key string, v interface{}, timeout time.Duration) (ok bool, err error) {
+	defer r.observe("setnx", key, time.Now(), 0, 0, &err)
+	b, err := encodeValue(r.codec(), v)
+	if err != nil {
+		return false, err
+	}
+	return r.Client.SetNX(r.Key(key, v), b, timeout).Result()
+}
+
+// GetSet stores v and decodes the previous value into old. It reports false
+// when there was no previous value.
+func (r *Redis) GetSet(key string, v interface{}, timeout time.Duration, old interface{}) (found bool, err error) {
+	defer r.observe("getset", key, time.Now(), 0, 0, &err)
+	b, err := encodeValue(r.codec(), v)
+	if err != nil {
+		return false, err
+	}
+	prev, err := getSetScript.Run(r.Client, []string{r.Key(key, v)}, b, ms(timeout)).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	s, ok := prev.(string)
+	if !ok {
+		return false, nil
+	}
+	if old != nil {
+		if err := decodeValue([]byte(s), old); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// Expire sets the timeout of key, pass a value like v for keys stored with
+// a registered schema version.
+func (r *Redis) Expire(key string, timeout time.Duration, v ...interface{}) (bool, error) {
+	return r.Client.PExpire(r.Key(key, first(v)), timeout).Result()
+}
+
+// TTL returns the remaining time to live of key, -1 when the key has no
+// expiry and redis.Nil when it does not exist.
+func (r *Redis) TTL(key string, v ...interface{}) (time.Duration, error) {
+	d, err := r.Client.PTTL(r.Key(key, first(v))).Result()
+	if err != nil {
+		return 0, err
+	}
+	if d == -2 {
+		return 0, redis.Nil
+	}
+	if d < 0 {
+		return -1, nil
+	}
+	return d, nil
+}
+
+// CompareAndSwap replaces the value of key with v only when it still holds
+// old, both encoded with the codec of r. A timeout of 0 keeps the current TTL.
+func (r *Redis) CompareAndSwap(key string, old interface{}, v interface{}, timeout time.Duration) (swapped bool, err error) {
+	defer r.observe("cas", key, time.Now(), 0, 0, &err)
+	ob, err := encodeValue(r.codec(), old)
+	if err != nil {
+		return false, err
+	}
+	nb, err := encodeValue(r.codec(), v)
+	if err != nil {
+		return false, err
+	}
+	n, err := compareAndSwapScript.Run(r.Client, []string{r.Key(key, v)}, ob, nb, ms(timeout)).Int64()
+	return n == 1, err
+}
+
+// Update reads key into v, lets fn modify v and writes it back. The write
+// only succeeds when nobody changed the key in between (WATCH), otherwise
+// the whole cycle is retried. fn sees v zeroed when the key does not exist.
+func (r *Redis) Update(key string, v interface{}, timeout time.Duration, fn func() error) (err error) {
+	defer r.observe("update", key, time.Now(), 0, 0, &err)
+	key = r.Key(key, v)
+	for i := 0; i < DefaultUpdateRetries; i++ {
+		err := r.Client.Watch(func(tx *redis.Tx) error {
+			rv := reflect.ValueOf(v).Elem()
+			rv.Set(reflect.Zero(rv.Type()))
+			b, err := tx.Get(key).Bytes()
+			if err != nil && err != redis.Nil {
+				return err
+			}
+			if err == nil {
+				if err := decodeValue(b, v); err != nil {
+					return err
+				}
+			}
+			if err := fn(); err != nil {
+				return err
+			}
+			nb, err := encodeValue(r.codec(), v)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.Set(key, nb, timeout)
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return ErrUpdateConflict
+}
+
+func first(v []interface{}) interface{} {
+	if len(v) > 0 {
+		return v[0]
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"io/ioutil"
+	"sync"
+)
+
+// Every encoded value starts with codecMagic followed by the codec id. Values
+// written before codecs existed have no header and are decoded as JSON.
+const codecMagic byte = 0xC5
+
+const (
+	JSONCodecID    byte = 'j'
+	MsgPackCodecID byte = 'm'
+	GobCodecID     byte = 'g'
+	GzipCodecID    byte = 'z'
+)
+
+const DefaultCompressThreshold = 1024
+
+type Codec interface {
+	ID() byte
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSON    Codec = jsonCodec{}
+	MsgPack Codec = msgpackCodec{}
+	Gob     Codec = gobCodec{}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{
+		JSONCodecID:    JSON,
+		MsgPackCodecID: MsgPack,
+		GobCodecID:     Gob,
+		GzipCodecID:    gzipCodec{},
+	}
+)
+
+// RegisterCodec makes a custom codec known to the decoder so values written
+// with it can be read back by Get.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.ID()] = c
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte {
+	return JSONCodecID
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// msgpackCodec reads the json struct tags so the same structs can be cached
+// with either codec.
+type msgpackCodec struct{}
+
+func (msgpackCodec) ID() byte {
+	return MsgPackCodecID
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ID() byte {
+	return GobCodecID
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// gzipCodec wraps another codec and compresses its output once it grows
+// beyond threshold. The payload keeps the header of the wrapped codec so the
+// value can be decoded without knowing which codec was wrapped.
+type gzipCodec struct {
+	inner     Codec
+	threshold int
+}
+
+// NewGzipCodec returns a codec compressing values of inner larger than
+// threshold bytes, a threshold <= 0 uses DefaultCompressThreshold.
+func NewGzipCodec(inner Codec, threshold int) Codec {
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	return gzipCodec{inner: inner, threshold: threshold}
+}
+
+func (gzipCodec) ID() byte {
+	return GzipCodecID
+}
+
+func (c gzipCodec) Marshal(v interface{}) ([]byte, error) {
+	if c.inner == nil {
+		return nil, fmt.Errorf("gzip codec requires an inner codec")
+	}
+	b, err := encodeValue(c.inner, v)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) <= c.threshold {
+		return append([]byte{0}, b...), nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(1)
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return fmt.Errorf("gzip codec: empty payload")
+	}
+	b := data[1:]
+	if data[0] == 1 {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if b, err = ioutil.ReadAll(r); err != nil {
+			return err
+		}
+	}
+	return decodeValue(b, v)
+}
+
+func encodeValue(c Codec, v interface{}) ([]byte, error) {
+	b, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{codecMagic, c.ID()}, b...), nil
+}
+
+func decodeValue(b []byte, v interface{}) error {
+	if len(b) < 2 || b[0] != codecMagic {
+		return json.Unmarshal(b, v)
+	}
+	codecsMu.RLock()
+	c, ok := codecs[b[1]]
+	codecsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown cache codec %q", b[1])
+	}
+	return c.Unmarshal(b[2:], v)
+}
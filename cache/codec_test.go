@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type codecValue struct {
+	Name  string   `json:"name"`
+	Count int      `json:"count"`
+	Tags  []string `json:"tags"`
+}
+
+func TestEncodeDecodeValue(t *testing.T) {
+	v := codecValue{Name: "alice", Count: 3, Tags: []string{"a", "b"}}
+	large := codecValue{Name: strings.Repeat("x", 4096)}
+	tests := []struct {
+		name  string
+		codec Codec
+		value codecValue
+		id    byte
+	}{
+		{name: "json", codec: JSON, value: v, id: JSONCodecID},
+		{name: "msgpack", codec: MsgPack, value: v, id: MsgPackCodecID},
+		{name: "gob", codec: Gob, value: v, id: GobCodecID},
+		{name: "gzip below threshold", codec: NewGzipCodec(JSON, 0), value: v, id: GzipCodecID},
+		{name: "gzip compressed", codec: NewGzipCodec(MsgPack, 0), value: large, id: GzipCodecID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := encodeValue(tt.codec, tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b[0] != codecMagic || b[1] != tt.id {
+				t.Fatalf("header = %x, want %x %x", b[:2], codecMagic, tt.id)
+			}
+			var got codecValue
+			if err := decodeValue(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.value) {
+				t.Errorf("decoded %+v, want %+v", got, tt.value)
+			}
+		})
+	}
+}
+
+func TestGzipCodecCompresses(t *testing.T) {
+	value := codecValue{Name: strings.Repeat("x", 4096)}
+	b, err := encodeValue(NewGzipCodec(JSON, 0), value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) >= 4096 || b[2] != 1 {
+		t.Errorf("value of %d bytes was not compressed", len(b))
+	}
+}
+
+func TestDecodeLegacyValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		value interface{}
+		want  interface{}
+	}{
+		{name: "object", data: []byte(`{"name":"bob","count":2}`), value: &codecValue{}, want: &codecValue{Name: "bob", Count: 2}},
+		{name: "string", data: []byte(`"plain"`), value: new(string), want: func() *string { s := "plain"; return &s }()},
+		{name: "number", data: []byte(`7`), value: new(int), want: func() *int { n := 7; return &n }()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := decodeValue(tt.data, tt.value); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.value, tt.want) {
+				t.Errorf("decoded %v, want %v", tt.value, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeValueErrors(t *testing.T) {
+	var v codecValue
+	if err := decodeValue([]byte{codecMagic, 'q', '{', '}'}, &v); err == nil {
+		t.Error("expected an error for an unknown codec")
+	}
+	if err := decodeValue([]byte(`{broken`), &v); err == nil {
+		t.Error("expected an error for invalid legacy JSON")
+	}
+	if _, err := (gzipCodec{}).Marshal(v); err == nil {
+		t.Error("expected an error for gzip without an inner codec")
+	}
+}
+
+type upperCodec struct{}
+
+func (upperCodec) ID() byte {
+	return 'u'
+}
+
+func (upperCodec) Marshal(v interface{}) ([]byte, error) {
+	return bytes.ToUpper([]byte(v.(string))), nil
+}
+
+func (upperCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*string) = string(bytes.ToLower(data))
+	return nil
+}
+
+func TestRegisterCodec(t *testing.T) {
+	RegisterCodec(upperCodec{})
+	b, err := encodeValue(upperCodec{}, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	if err := decodeValue(b, &got); err != nil || got != "hello" {
+		t.Errorf("decoded %q, %v", got, err)
+	}
+}
@@ -0,0 +1,307 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	HeaderIdempotencyKey      = "Idempotency-Key"
+	HeaderIdempotentReplayed  = "Idempotent-Replayed"
+	DefaultIdempotencyTTL     = 24 * time.Hour
+	DefaultIdempotencyLockTTL = time.Minute
+	DefaultIdempotencyPrefix  = "idempotency"
+	DefaultIdempotencyMaxBody = 1 << 20
+)
+
+var ErrIdempotencyBodyTooLarge = errors.New("request body too large")
+
+const (
+	idempotencyProcessing = "processing"
+	idempotencyDone       = "done"
+)
+
+type IdempotencyConfig struct {
+	Header string
+	// TTL is how long a finished response is replayed.
+	TTL time.Duration
+	// LockTTL bounds how long a request holds the key while it runs.
+	LockTTL   time.Duration
+	KeyPrefix string
+	// Methods guarded by the middleware, default POST and PATCH.
+	Methods []string
+	// MaxBodySize in bytes of a guarded request, larger ones are rejected
+	// with 413 since the body is read into memory to be hashed. Default is
+	// DefaultIdempotencyMaxBody.
+	MaxBodySize int64
+	// Scope returns the caller of a request, for example the user id or API
+	// key, so callers never share keys. Default is the Authorization header.
+	Scope func(req *http.Request) string
+}
+
+type IdempotencyStore struct {
+	r      *Redis
+	config IdempotencyConfig
+}
+
+type IdempotencyRecord struct {
+	State       string      `json:"state"`
+	RequestHash string      `json:"request_hash"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+func NewIdempotencyStore(r *Redis, config IdempotencyConfig) *IdempotencyStore {
+	if config.Header == "" {
+		config.Header = HeaderIdempotencyKey
+	}
+	if config.TTL <= 0 {
+		config.TTL = DefaultIdempotencyTTL
+	}
+	if config.LockTTL <= 0 {
+		config.LockTTL = DefaultIdempotencyLockTTL
+	}
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = DefaultIdempotencyPrefix
+	}
+	if len(config.Methods) == 0 {
+		config.Methods = []string{http.MethodPost, http.MethodPatch}
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = DefaultIdempotencyMaxBody
+	}
+	if config.Scope == nil {
+		config.Scope = func(req *http.Request) string {
+			return req.Header.Get(echo.HeaderAuthorization)
+		}
+	}
+	return &IdempotencyStore{r: r, config: config}
+}
+
+// Begin locks key for a request with the given hash. When the key is already
+// taken it returns the existing record and false.
+func (s *IdempotencyStore) Begin(key string, hash string) (IdempotencyRecord, bool, error) {
+	rec := IdempotencyRecord{State: idempotencyProcessing, RequestHash: hash}
+	ok, err := s.r.SetNX(s.key(key), &rec, s.config.LockTTL)
+	if err != nil || ok {
+		return rec, ok, err
+	}
+	var existing IdempotencyRecord
+	if err := s.r.Get(s.key(key), &existing); err != nil {
+		if s.r.IsKeyNotFound(err) {
+			// the lock expired in between, try once more
+			ok, err = s.r.SetNX(s.key(key), &rec, s.config.LockTTL)
+			return rec, ok, err
+		}
+		return existing, false, err
+	}
+	return existing, false, nil
+}
+
+// Complete stores the final response of key for replay.
+func (s *IdempotencyStore) Complete(key string, rec IdempotencyRecord) error {
+	rec.State = idempotencyDone
+	return s.r.Set(s.key(key), &rec, s.config.TTL)
+}
+
+// Release unlocks key without storing a response so the client may retry.
+func (s *IdempotencyStore) Release(key string) error {
+	return s.r.Del(s.key(key), (*IdempotencyRecord)(nil))
+}
+
+func (s *IdempotencyStore) EchoMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			key := req.Header.Get(s.config.Header)
+			if key == "" || !s.guarded(req.Method) {
+				return next(c)
+			}
+			key = s.scoped(req, key)
+			hash, err := requestHash(req, s.config.MaxBodySize)
+			if err != nil {
+				return echo.NewHTTPError(bodyErrorStatus(err), err.Error())
+			}
+			rec, acquired, err := s.Begin(key, hash)
+			if err != nil {
+				return err
+			}
+			if !acquired {
+				if code, msg := s.reject(rec, hash); code != 0 {
+					return echo.NewHTTPError(code, msg)
+				}
+				replay(c.Response(), rec)
+				return nil
+			}
+			w := &responseRecorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = w
+			err = next(c)
+			if err != nil {
+				c.Error(err)
+			}
+			s.finish(key, hash, c.Response().Status, c.Response().Header(), w.body.Bytes())
+			return nil
+		}
+	}
+}
+
+func (s *IdempotencyStore) GinMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(s.config.Header)
+		if key == "" || !s.guarded(c.Request.Method) {
+			c.Next()
+			return
+		}
+		key = s.scoped(c.Request, key)
+		hash, err := requestHash(c.Request, s.config.MaxBodySize)
+		if err != nil {
+			_ = c.AbortWithError(bodyErrorStatus(err), err)
+			return
+		}
+		rec, acquired, err := s.Begin(key, hash)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if !acquired {
+			if code, msg := s.reject(rec, hash); code != 0 {
+				c.AbortWithStatusJSON(code, map[string]interface{}{"error": msg})
+				return
+			}
+			replay(c.Writer, rec)
+			c.Abort()
+			return
+		}
+		w := &ginResponseRecorder{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		s.finish(key, hash, w.Status(), w.Header(), w.body.Bytes())
+	}
+}
+
+func (s *IdempotencyStore) reject(rec IdempotencyRecord, hash string) (int, string) {
+	if rec.RequestHash != hash {
+		return http.StatusUnprocessableEntity, "Idempotency key was used with a different request"
+	}
+	if rec.State != idempotencyDone {
+		return http.StatusConflict, "Request with this idempotency key is still in progress"
+	}
+	return 0, ""
+}
+
+// finish stores the response without cookies, server errors release the key
+// instead so the client can retry them.
+func (s *IdempotencyStore) finish(key string, hash string, status int, header http.Header, body []byte) {
+	var err error
+	if status >= http.StatusInternalServerError {
+		err = s.Release(key)
+	} else {
+		header = header.Clone()
+		header.Del(echo.HeaderSetCookie)
+		err = s.Complete(key, IdempotencyRecord{
+			RequestHash: hash,
+			Status:      status,
+			Header:      header,
+			Body:        body,
+		})
+	}
+	if err != nil {
+		log.Errorln("Idempotency store error -:", err)
+	}
+}
+
+func (s *IdempotencyStore) guarded(method string) bool {
+	for _, m := range s.config.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// scoped prefixes key with a hash of the caller, so the store key does not
+// reveal credentials. Anonymous callers get the hash of the empty scope.
+func (s *IdempotencyStore) scoped(req *http.Request, key string) string {
+	sum := sha256.Sum256([]byte(s.config.Scope(req)))
+	return hex.EncodeToString(sum[:16]) + ":" + key
+}
+
+func (s *IdempotencyStore) key(key string) string {
+	return fmt.Sprintf("%s:%s", s.config.KeyPrefix, key)
+}
+
+func replay(w http.ResponseWriter, rec IdempotencyRecord) {
+	for k, values := range rec.Header {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	w.Header().Set(HeaderIdempotentReplayed, "true")
+	w.WriteHeader(rec.Status)
+	_, _ = w.Write(rec.Body)
+}
+
+// requestHash fingerprints method, path, query and body, the body is
+// restored so the handler can still read it. A body over maxBody bytes
+// returns ErrIdempotencyBodyTooLarge.
+func requestHash(req *http.Request, maxBody int64) (string, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(io.LimitReader(req.Body, maxBody+1)); err != nil {
+			return "", err
+		}
+		if int64(len(body)) > maxBody {
+			return "", ErrIdempotencyBodyTooLarge
+		}
+		_ = req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	h := sha256.New()
+	_, _ = io.WriteString(h, req.Method+" "+req.URL.Path+"?"+req.URL.RawQuery+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func bodyErrorStatus(err error) int {
+	if err == ErrIdempotencyBodyTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+type ginResponseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *ginResponseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *ginResponseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
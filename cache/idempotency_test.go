@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/echo/v4"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type failingBody struct{}
+
+func (failingBody) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	r, _ := newTestRedis(t)
+	s := NewIdempotencyStore(r, IdempotencyConfig{MaxBodySize: 8})
+	var calls int
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(req.Body)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(body)
+	}
+	e := echo.New()
+	e.Use(s.EchoMiddleware())
+	e.POST("/items", echo.WrapHandler(http.HandlerFunc(handler)))
+	gin.SetMode(gin.TestMode)
+	g := gin.New()
+	g.Use(s.GinMiddleware())
+	g.POST("/items", gin.WrapF(handler))
+
+	servers := map[string]http.Handler{"echo": e, "gin": g}
+	for name, server := range servers {
+		t.Run(name, func(t *testing.T) {
+			calls = 0
+			tests := []struct {
+				name     string
+				key      string
+				body     io.Reader
+				status   int
+				replayed bool
+			}{
+				{name: "first request", key: name + "-1", body: strings.NewReader("12345678"), status: http.StatusCreated},
+				{name: "replay", key: name + "-1", body: strings.NewReader("12345678"), status: http.StatusCreated, replayed: true},
+				{name: "oversized body", key: name + "-2", body: strings.NewReader("123456789"), status: http.StatusRequestEntityTooLarge},
+				{name: "unreadable body", key: name + "-3", body: failingBody{}, status: http.StatusBadRequest},
+			}
+			for _, tt := range tests {
+				req := httptest.NewRequest(http.MethodPost, "/items", tt.body)
+				req.Header.Set(HeaderIdempotencyKey, tt.key)
+				w := httptest.NewRecorder()
+				server.ServeHTTP(w, req)
+				if w.Code != tt.status {
+					t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+				}
+				if replayed := w.Header().Get(HeaderIdempotentReplayed) == "true"; replayed != tt.replayed {
+					t.Errorf("%s: replayed = %v, want %v", tt.name, replayed, tt.replayed)
+				}
+			}
+			if calls != 1 {
+				t.Errorf("handler called %d times, want 1", calls)
+			}
+		})
+	}
+}
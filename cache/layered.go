@@ -0,0 +1,325 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/json"
+	"github.com/go-redis/redis/v7"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultInvalidationChannel = "cache:invalidate"
+	DefaultLayeredLocalTTL     = time.Minute
+)
+
+// LayeredCache keeps recently used values in an in-process LRU (L1) in front
+// of redis (L2). Writes and deletes are broadcast over redis pub/sub so every
+// replica drops its local copy of the key.
+type LayeredCache struct {
+	r        *Redis
+	l1       *lru
+	channel  string
+	origin   string
+	pubSub   *redis.PubSub
+	stop     chan struct{}
+	done     chan struct{}
+	l1Hits   uint64
+	l1Misses uint64
+	l2Hits   uint64
+	l2Misses uint64
+}
+
+type LayeredStats struct {
+	L1Hits   uint64 `json:"l1_hits"`
+	L1Misses uint64 `json:"l1_misses"`
+	L2Hits   uint64 `json:"l2_hits"`
+	L2Misses uint64 `json:"l2_misses"`
+	L1Size   int    `json:"l1_size"`
+}
+
+type invalidation struct {
+	Origin string   `json:"origin"`
+	Keys   []string `json:"keys"`
+	All    bool     `json:"all,omitempty"`
+}
+
+// NewLayeredCache creates a layered cache holding up to size entries locally
+// for at most localTTL, default DefaultLayeredLocalTTL, or until the key
+// expires in Redis if that is sooner. It bounds how long a copy read while
+// another replica invalidated the key stays stale. An empty
+// channel uses DefaultInvalidationChannel.
+func NewLayeredCache(r *Redis, size int, localTTL time.Duration, channel string) *LayeredCache {
+	if localTTL <= 0 {
+		localTTL = DefaultLayeredLocalTTL
+	}
+	if channel == "" {
+		channel = DefaultInvalidationChannel
+	}
+	return &LayeredCache{
+		r:       r,
+		l1:      newLRU(size, localTTL),
+		channel: channel,
+		origin:  uuid.NewV4().String(),
+	}
+}
+
+// Start subscribes to the invalidation channel, it must be called before the
+// cache is shared between replicas.
+func (c *LayeredCache) Start() error {
+	c.pubSub = c.r.Client.Subscribe(c.r.Key(c.channel, nil))
+	if _, err := c.pubSub.Receive(); err != nil {
+		_ = c.pubSub.Close()
+		return err
+	}
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.listen()
+	return nil
+}
+
+func (c *LayeredCache) Close() error {
+	if c.pubSub == nil {
+		return nil
+	}
+	close(c.stop)
+	err := c.pubSub.Close()
+	<-c.done
+	return err
+}
+
+func (c *LayeredCache) Get(key string, v interface{}) error {
+	key = c.r.Key(key, v)
+	if b, ok := c.l1.get(key); ok {
+		atomic.AddUint64(&c.l1Hits, 1)
+		return decodeOptional(b, v)
+	}
+	atomic.AddUint64(&c.l1Misses, 1)
+	pipe := c.r.Client.Pipeline()
+	get := pipe.Get(key)
+	ttl := pipe.PTTL(key)
+	if _, err := pipe.Exec(); err != nil {
+		if err == redis.Nil {
+			atomic.AddUint64(&c.l2Misses, 1)
+		}
+		return err
+	}
+	b, err := get.Bytes()
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.l2Hits, 1)
+	c.l1.set(key, b, ttl.Val())
+	return decodeOptional(b, v)
+}
+
+func (c *LayeredCache) Set(key string, v interface{}, timeout time.Duration) error {
+	b, err := encodeValue(c.r.codec(), v)
+	if err != nil {
+		return err
+	}
+	key = c.r.Key(key, v)
+	if err := c.r.Client.Set(key, b, timeout).Err(); err != nil {
+		return err
+	}
+	c.l1.set(key, b, timeout)
+	return c.publish(invalidation{Keys: []string{key}})
+}
+
+// Del removes keys stored without a registered schema version.
+func (c *LayeredCache) Del(keys ...string) error {
+	redisKeys := make([]string, len(keys))
+	for i, key := range keys {
+		redisKeys[i] = c.r.Key(key, nil)
+	}
+	return c.del(redisKeys)
+}
+
+// DelTyped removes key stored with a value like v.
+func (c *LayeredCache) DelTyped(key string, v interface{}) error {
+	return c.del([]string{c.r.Key(key, v)})
+}
+
+func (c *LayeredCache) del(keys []string) error {
+	if err := c.r.Client.Del(keys...).Err(); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		c.l1.del(key)
+	}
+	return c.publish(invalidation{Keys: keys})
+}
+
+// Purge drops the local copies of every replica without touching redis.
+func (c *LayeredCache) Purge() error {
+	c.l1.purge()
+	return c.publish(invalidation{All: true})
+}
+
+func (c *LayeredCache) Stats() LayeredStats {
+	return LayeredStats{
+		L1Hits:   atomic.LoadUint64(&c.l1Hits),
+		L1Misses: atomic.LoadUint64(&c.l1Misses),
+		L2Hits:   atomic.LoadUint64(&c.l2Hits),
+		L2Misses: atomic.LoadUint64(&c.l2Misses),
+		L1Size:   c.l1.len(),
+	}
+}
+
+func (s LayeredStats) L1HitRatio() float64 {
+	return ratio(s.L1Hits, s.L1Misses)
+}
+
+func (s LayeredStats) L2HitRatio() float64 {
+	return ratio(s.L2Hits, s.L2Misses)
+}
+
+func (c *LayeredCache) publish(msg invalidation) error {
+	msg.Origin = c.origin
+	j, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+	return c.r.Client.Publish(c.r.Key(c.channel, nil), j).Err()
+}
+
+func (c *LayeredCache) listen() {
+	defer close(c.done)
+	for {
+		m, err := c.pubSub.Receive()
+		if err != nil {
+			select {
+			case <-c.stop:
+				return
+			case <-time.After(time.Second):
+			}
+			// Messages may have been lost while the connection was down.
+			c.l1.purge()
+			continue
+		}
+		switch msg := m.(type) {
+		case *redis.Subscription:
+			c.l1.purge()
+		case *redis.Message:
+			var inv invalidation
+			if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil {
+				log.Errorln("Cache invalidation decode error -:", err)
+				continue
+			}
+			if inv.Origin == c.origin {
+				continue
+			}
+			if inv.All {
+				c.l1.purge()
+				continue
+			}
+			for _, key := range inv.Keys {
+				c.l1.del(key)
+			}
+		}
+	}
+}
+
+func decodeOptional(b []byte, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	return decodeValue(b, v)
+}
+
+func ratio(hits uint64, misses uint64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+type lru struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key      string
+	value    []byte
+	expireAt time.Time
+}
+
+func newLRU(size int, ttl time.Duration) *lru {
+	return &lru{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (l *lru) get(key string) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*lruEntry)
+	if time.Now().After(entry.expireAt) {
+		l.remove(e)
+		return nil, false
+	}
+	l.ll.MoveToFront(e)
+	return entry.value, true
+}
+
+// set keeps the value for the local ttl or the given ttl, whichever is shorter,
+// so a copy never outlives the key in Redis. A ttl <= 0 means no Redis expiry.
+func (l *lru) set(key string, value []byte, ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ttl <= 0 || ttl > l.ttl {
+		ttl = l.ttl
+	}
+	expireAt := time.Now().Add(ttl)
+	if e, ok := l.items[key]; ok {
+		entry := e.Value.(*lruEntry)
+		entry.value = value
+		entry.expireAt = expireAt
+		l.ll.MoveToFront(e)
+		return
+	}
+	l.items[key] = l.ll.PushFront(&lruEntry{key: key, value: value, expireAt: expireAt})
+	for l.size > 0 && l.ll.Len() > l.size {
+		l.remove(l.ll.Back())
+	}
+}
+
+func (l *lru) del(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.items[key]; ok {
+		l.remove(e)
+	}
+}
+
+func (l *lru) purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ll.Init()
+	l.items = map[string]*list.Element{}
+}
+
+func (l *lru) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ll.Len()
+}
+
+func (l *lru) remove(e *list.Element) {
+	l.ll.Remove(e)
+	delete(l.items, e.Value.(*lruEntry).key)
+}
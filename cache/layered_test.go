@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func localTTL(t *testing.T, c *LayeredCache, key string) time.Duration {
+	c.l1.mu.Lock()
+	defer c.l1.mu.Unlock()
+	e, ok := c.l1.items[c.r.Key(key, nil)]
+	if !ok {
+		t.Fatalf("%s is not cached locally", key)
+	}
+	return time.Until(e.Value.(*lruEntry).expireAt)
+}
+
+func TestLayeredCacheLocalTTL(t *testing.T) {
+	r, _ := newTestRedis(t)
+	c := NewLayeredCache(r, 10, time.Minute, "")
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		max     time.Duration
+	}{
+		{name: "shorter redis timeout", timeout: 5 * time.Second, max: 5 * time.Second},
+		{name: "longer redis timeout", timeout: time.Hour, max: time.Minute},
+		{name: "no redis timeout", timeout: 0, max: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.Set(tt.name, "v", tt.timeout); err != nil {
+				t.Fatal(err)
+			}
+			if ttl := localTTL(t, c, tt.name); ttl > tt.max || ttl < tt.max-time.Second {
+				t.Errorf("local ttl after Set = %v, want %v", ttl, tt.max)
+			}
+			// a read from Redis is capped by the remaining ttl of the key
+			c.l1.purge()
+			var got string
+			if err := c.Get(tt.name, &got); err != nil || got != "v" {
+				t.Fatalf("Get = %q, %v", got, err)
+			}
+			if ttl := localTTL(t, c, tt.name); ttl > tt.max || ttl < tt.max-time.Second {
+				t.Errorf("local ttl after Get = %v, want %v", ttl, tt.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultLeaseTTL = 15 * time.Second
+
+type LeaderConfig struct {
+	// LeaseTTL is how long a lease is valid without being renewed.
+	LeaseTTL time.Duration
+	// RenewInterval is how often the lease is renewed or, by followers,
+	// tried to be acquired. Default is a third of LeaseTTL.
+	RenewInterval time.Duration
+	// OnElected runs in its own goroutine when this replica becomes leader,
+	// ctx is canceled when leadership is lost.
+	OnElected func(ctx context.Context)
+	// OnRevoked is called when this replica stops being leader.
+	OnRevoked func()
+}
+
+// Leader elects one replica among all replicas using the same name through
+// a lease key in redis.
+type Leader struct {
+	r       *Redis
+	name    string
+	id      string
+	config  LeaderConfig
+	leader  int32
+	cancel  context.CancelFunc
+	stop    chan struct{}
+	done    chan struct{}
+	mu      sync.Mutex
+	renewed time.Time
+}
+
+var leaseRenewScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var leaseReleaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func NewLeader(r *Redis, name string, config LeaderConfig) *Leader {
+	if config.LeaseTTL <= 0 {
+		config.LeaseTTL = DefaultLeaseTTL
+	}
+	if config.RenewInterval <= 0 || config.RenewInterval >= config.LeaseTTL {
+		config.RenewInterval = config.LeaseTTL / 3
+	}
+	host, _ := os.Hostname()
+	return &Leader{
+		r:      r,
+		name:   name,
+		id:     fmt.Sprintf("%s-%s", host, uuid.NewV4().String()[:8]),
+		config: config,
+	}
+}
+
+func (l *Leader) ID() string {
+	return l.id
+}
+
+func (l *Leader) IsLeader() bool {
+	return atomic.LoadInt32(&l.leader) == 1
+}
+
+// CurrentLeader returns the id of the replica holding the lease, redis.Nil
+// when there is no leader.
+func (l *Leader) CurrentLeader() (string, error) {
+	return l.r.Client.Get(l.key()).Result()
+}
+
+// Start takes part in the election until Stop is called.
+func (l *Leader) Start() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop != nil {
+		return
+	}
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.run()
+}
+
+// Stop leaves the election and gives up the lease when held, so another
+// replica can take over without waiting for the lease to expire.
+func (l *Leader) Stop() error {
+	l.mu.Lock()
+	if l.stop == nil {
+		l.mu.Unlock()
+		return nil
+	}
+	close(l.stop)
+	l.mu.Unlock()
+	<-l.done
+	l.mu.Lock()
+	l.stop = nil
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *Leader) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.config.RenewInterval)
+	defer ticker.Stop()
+	for {
+		l.tick()
+		select {
+		case <-l.stop:
+			l.stepDown()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *Leader) tick() {
+	if l.IsLeader() {
+		n, err := leaseRenewScript.Run(l.r.Client, []string{l.key()}, l.id, ms(l.config.LeaseTTL)).Int64()
+		if err == nil && n == 1 {
+			l.renewed = time.Now()
+			return
+		}
+		if err != nil {
+			log.Errorln("Leader lease renew error -:", err)
+			// keep leading while the lease surely has not expired yet
+			if time.Since(l.renewed)+l.config.RenewInterval < l.config.LeaseTTL {
+				return
+			}
+		}
+		l.revoke()
+		return
+	}
+	ok, err := l.r.Client.SetNX(l.key(), l.id, l.config.LeaseTTL).Result()
+	if err != nil {
+		log.Errorln("Leader lease acquire error -:", err)
+		return
+	}
+	if ok {
+		l.renewed = time.Now()
+		l.elect()
+	}
+}
+
+func (l *Leader) elect() {
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+	atomic.StoreInt32(&l.leader, 1)
+	log.Infof("Leader %s elected as %s", l.name, l.id)
+	if l.config.OnElected != nil {
+		go l.config.OnElected(ctx)
+	}
+}
+
+func (l *Leader) revoke() {
+	if !l.IsLeader() {
+		return
+	}
+	atomic.StoreInt32(&l.leader, 0)
+	l.cancel()
+	log.Infof("Leader %s revoked from %s", l.name, l.id)
+	if l.config.OnRevoked != nil {
+		l.config.OnRevoked()
+	}
+}
+
+func (l *Leader) stepDown() {
+	if !l.IsLeader() {
+		return
+	}
+	if err := leaseReleaseScript.Run(l.r.Client, []string{l.key()}, l.id).Err(); err != nil {
+		log.Errorln("Leader lease release error -:", err)
+	}
+	l.revoke()
+}
+
+func (l *Leader) key() string {
+	return l.r.Key(fmt.Sprintf("leader:%s", l.name), nil)
+}
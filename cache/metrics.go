@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// Event describes one cache operation. Hits and Misses are only set by
+// lookups, a missing key is not reported as Err.
+type Event struct {
+	Op       string
+	Key      string
+	Hits     int
+	Misses   int
+	Duration time.Duration
+	Err      error
+}
+
+type Hook func(e Event)
+
+// AddHook registers h to be called after every cache operation.
+func (r *Redis) AddHook(h Hook) {
+	r.hooks = append(r.hooks, h)
+}
+
+// EnableMetrics registers a Metrics collector for r on the default
+// prometheus registry, the metrics are served by the server metrics path.
+func (r *Redis) EnableMetrics(nameSpace string) error {
+	m := NewMetrics(nameSpace)
+	if err := prometheus.Register(m); err != nil {
+		return err
+	}
+	r.AddHook(m.Hook())
+	return nil
+}
+
+func (r *Redis) observe(op string, key string, start time.Time, hits int, misses int, errp *error) {
+	if len(r.hooks) == 0 {
+		return
+	}
+	e := Event{
+		Op:       op,
+		Key:      key,
+		Hits:     hits,
+		Misses:   misses,
+		Duration: time.Since(start),
+	}
+	if errp != nil && *errp != nil {
+		if *errp == redis.Nil {
+			e.Misses += e.Hits
+			e.Hits = 0
+		} else {
+			e.Hits, e.Misses = 0, 0
+			e.Err = *errp
+		}
+	}
+	for _, h := range r.hooks {
+		h(e)
+	}
+}
+
+// Metrics is a prometheus collector fed by the cache hooks.
+type Metrics struct {
+	operations *prometheus.CounterVec
+	hits       *prometheus.CounterVec
+	misses     *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+}
+
+func NewMetrics(nameSpace string) *Metrics {
+	labels := []string{"op"}
+	return &Metrics{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: nameSpace,
+			Subsystem: "cache",
+			Name:      "operations_total",
+			Help:      "Number of cache operations.",
+		}, labels),
+		hits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: nameSpace,
+			Subsystem: "cache",
+			Name:      "hits_total",
+			Help:      "Number of keys found by cache lookups.",
+		}, labels),
+		misses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: nameSpace,
+			Subsystem: "cache",
+			Name:      "misses_total",
+			Help:      "Number of keys not found by cache lookups.",
+		}, labels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: nameSpace,
+			Subsystem: "cache",
+			Name:      "errors_total",
+			Help:      "Number of failed cache operations.",
+		}, labels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: nameSpace,
+			Subsystem: "cache",
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of cache operations.",
+			Buckets: []float64{
+				0.0005, // 0.5ms
+				0.001,  // 1ms
+				0.005,  // 5ms
+				0.01,   // 10ms
+				0.05,   // 50ms
+				0.1,    // 100ms
+				0.5,    // 500ms
+				1,      // 1s
+				2,      // 2s
+				5,      // 5s
+				10,     // 10s
+			},
+		}, labels),
+	}
+}
+
+func (m *Metrics) Hook() Hook {
+	return func(e Event) {
+		m.operations.WithLabelValues(e.Op).Inc()
+		m.duration.WithLabelValues(e.Op).Observe(e.Duration.Seconds())
+		if e.Hits > 0 {
+			m.hits.WithLabelValues(e.Op).Add(float64(e.Hits))
+		}
+		if e.Misses > 0 {
+			m.misses.WithLabelValues(e.Op).Add(float64(e.Misses))
+		}
+		if e.Err != nil {
+			m.errors.WithLabelValues(e.Op).Inc()
+		}
+	}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.operations.Describe(ch)
+	m.hits.Describe(ch)
+	m.misses.Describe(ch)
+	m.errors.Describe(ch)
+	m.duration.Describe(ch)
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.operations.Collect(ch)
+	m.hits.Collect(ch)
+	m.misses.Collect(ch)
+	m.errors.Collect(ch)
+	m.duration.Collect(ch)
+}
@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+	"reflect"
+	"time"
+)
+
+const (
+	subscribeMinBackoff = 100 * time.Millisecond
+	subscribeMaxBackoff = 30 * time.Second
+)
+
+type Message struct {
+	Channel string
+	Pattern string
+	Payload []byte
+}
+
+// Handler is called for every received message. Returned errors are logged
+// and do not stop the subscription.
+type Handler func(ctx context.Context, msg Message) error
+
+// Decode unmarshals the payload written by Publish into v.
+func (m Message) Decode(v interface{}) error {
+	return decodeValue(m.Payload, v)
+}
+
+// TypedHandler adapts fn of the form func(context.Context, T) error, where T
+// is any type the payload can be decoded into, to a Handler. It panics when
+// fn has another signature.
+func TypedHandler(fn interface{}) Handler {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	ctxType := reflect.TypeOf((*context.Context)(nil)).Elem()
+	errType := reflect.TypeOf((*error)(nil)).Elem()
+	if ft.Kind() != reflect.Func || ft.NumIn() != 2 || ft.NumOut() != 1 ||
+		ft.In(0) != ctxType || ft.Out(0) != errType {
+		panic(fmt.Sprintf("cache: invalid typed handler %s", ft))
+	}
+	argType := ft.In(1)
+	return func(ctx context.Context, msg Message) error {
+		arg := reflect.New(argType)
+		if err := msg.Decode(arg.Interface()); err != nil {
+			return err
+		}
+		out := fv.Call([]reflect.Value{reflect.ValueOf(ctx), arg.Elem()})
+		if err, ok := out[0].Interface().(error); ok {
+			return err
+		}
+		return nil
+	}
+}
+
+// Publish encodes v with the codec of r and publishes it on channel.
+func (r *Redis) Publish(ctx context.Context, channel string, v interface{}) error {
+	b, err := encodeValue(r.codec(), v)
+	if err != nil {
+		return err
+	}
+	return r.Client.WithContext(ctx).Publish(r.Key(channel, nil), b).Err()
+}
+
+// Subscribe delivers messages of channels to handler until ctx is canceled.
+// Connection failures are retried with backoff and the channels are
+// subscribed again after redis comes back.
+func (r *Redis) Subscribe(ctx context.Context, handler Handler, channels ...string) error {
+	return r.subscribe(ctx, handler, false, channels)
+}
+
+// PSubscribe works like Subscribe with glob-style channel patterns.
+func (r *Redis) PSubscribe(ctx context.Context, handler Handler, patterns ...string) error {
+	return r.subscribe(ctx, handler, true, patterns)
+}
+
+func (r *Redis) subscribe(ctx context.Context, handler Handler, pattern bool, channels []string) error {
+	names := make([]string, len(channels))
+	for i, channel := range channels {
+		names[i] = r.Key(channel, nil)
+	}
+	var ps *redis.PubSub
+	if pattern {
+		ps = r.Client.PSubscribe(names...)
+	} else {
+		ps = r.Client.Subscribe(names...)
+	}
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
+		}
+		_ = ps.Close()
+	}()
+	backoff := subscribeMinBackoff
+	for {
+		m, err := ps.Receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Errorln("Redis subscribe error -:", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > subscribeMaxBackoff {
+				backoff = subscribeMaxBackoff
+			}
+			continue
+		}
+		backoff = subscribeMinBackoff
+		if msg, ok := m.(*redis.Message); ok {
+			if err := handler(ctx, Message{
+				Channel: r.unprefix(msg.Channel),
+				Pattern: r.unprefix(msg.Pattern),
+				Payload: []byte(msg.Payload),
+			}); err != nil {
+				log.Errorf("Redis subscribe handler error on %s -: %v", msg.Channel, err)
+			}
+		}
+	}
+}
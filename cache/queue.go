@@ -0,0 +1,539 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultQueueMaxRetries        = 5
+	DefaultQueueMinBackoff        = time.Second
+	DefaultQueueMaxBackoff        = 10 * time.Minute
+	DefaultQueueVisibilityTimeout = 5 * time.Minute
+	DefaultQueuePollInterval      = time.Second
+)
+
+var ErrQueueStarted = errors.New("queue already started")
+
+type QueueConfig struct {
+	// Group is the consumer group shared by all replicas, default is the
+	// queue name.
+	Group string
+	// Consumer identifies this replica inside the group, default is the
+	// hostname with a random suffix.
+	Consumer string
+	// MaxRetries is how many times a failed job is retried before it is
+	// moved to the dead-letter stream, default is DefaultQueueMaxRetries, a
+	// negative value disables retrying.
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// VisibilityTimeout is how long a job may run before other consumers
+	// claim it again, it is also the deadline of the handler context.
+	VisibilityTimeout time.Duration
+	PollInterval      time.Duration
+}
+
+type Job struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Payload []byte `json:"payload"`
+	// Attempt is how many times the job failed before, a delivery that
+	// crashed its consumer counts as a failure too.
+	Attempt    int       `json:"attempt"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	Error      string    `json:"error,omitempty"`
+	// StreamID is the redis stream entry id of the current delivery.
+	StreamID string `json:"-"`
+}
+
+// Decode unmarshals the job payload into v.
+func (j *Job) Decode(v interface{}) error {
+	return decodeValue(j.Payload, v)
+}
+
+type JobHandler func(ctx context.Context, job *Job) error
+
+// TypedJob adapts fn of the form func(context.Context, T) error to a
+// JobHandler decoding the payload into T. It panics when fn has another
+// signature.
+func TypedJob(fn interface{}) JobHandler {
+	h := TypedHandler(fn)
+	return func(ctx context.Context, job *Job) error {
+		return h(ctx, Message{Channel: job.Type, Payload: job.Payload})
+	}
+}
+
+// Queue is a job queue on redis streams. Every job type has its own stream
+// and its own pool of workers, delayed and retried jobs wait in a sorted set
+// until they are due.
+type Queue struct {
+	r        *Redis
+	name     string
+	config   QueueConfig
+	mu       sync.Mutex
+	types    map[string]*jobType
+	started  bool
+	stop     chan struct{}
+	inFlight sync.WaitGroup
+	loops    sync.WaitGroup
+}
+
+type jobType struct {
+	name        string
+	handler     JobHandler
+	concurrency int
+	claimed     chan claimedJob
+}
+
+// claimedJob is a stream entry taken over from another consumer, deliveries
+// counts the earlier deliveries that were never acked.
+type claimedJob struct {
+	msg        redis.XMessage
+	deliveries int64
+}
+
+// moves due jobs from the delayed set to the stream of their type
+var queuePromoteScript = redis.NewScript(`
+local jobs = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[3]))
+for _, job in ipairs(jobs) do
+	local t = cjson.decode(job)['type']
+	redis.call('XADD', ARGV[2] .. t, '*', 'job', job)
+	redis.call('ZREM', KEYS[1], job)
+end
+return #jobs
+`)
+
+func NewQueue(r *Redis, name string, config QueueConfig) *Queue {
+	if config.Group == "" {
+		config.Group = name
+	}
+	if config.Consumer == "" {
+		host, _ := os.Hostname()
+		config.Consumer = fmt.Sprintf("%s-%s", host, uuid.NewV4().String()[:8])
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = DefaultQueueMaxRetries
+	} else if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = DefaultQueueMinBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = DefaultQueueMaxBackoff
+	}
+	if config.VisibilityTimeout <= 0 {
+		config.VisibilityTimeout = DefaultQueueVisibilityTimeout
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = DefaultQueuePollInterval
+	}
+	return &Queue{
+		r:      r,
+		name:   name,
+		config: config,
+		types:  map[string]*jobType{},
+	}
+}
+
+// Register sets the handler of a job type and how many jobs of the type run
+// at the same time on this replica. It must be called before Start.
+func (q *Queue) Register(name string, concurrency int, handler JobHandler) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.types[name] = &jobType{
+		name:        name,
+		handler:     handler,
+		concurrency: concurrency,
+		claimed:     make(chan claimedJob),
+	}
+}
+
+func (q *Queue) Enqueue(ctx context.Context, jobType string, v interface{}) (string, error) {
+	job, err := q.newJob(jobType, v)
+	if err != nil {
+		return "", err
+	}
+	j, err := json.Marshal(&job)
+	if err != nil {
+		return "", err
+	}
+	err = q.r.Client.WithContext(ctx).XAdd(&redis.XAddArgs{
+		Stream: q.streamKey(jobType),
+		Values: map[string]interface{}{"job": j},
+	}).Err()
+	return job.ID, err
+}
+
+func (q *Queue) EnqueueIn(ctx context.Context, jobType string, v interface{}, delay time.Duration) (string, error) {
+	return q.EnqueueAt(ctx, jobType, v, time.Now().Add(delay))
+}
+
+// EnqueueAt schedules the job to run once at has passed.
+func (q *Queue) EnqueueAt(ctx context.Context, jobType string, v interface{}, at time.Time) (string, error) {
+	job, err := q.newJob(jobType, v)
+	if err != nil {
+		return "", err
+	}
+	return job.ID, q.schedule(q.r.Client.WithContext(ctx), job, at)
+}
+
+// Start creates the consumer groups and runs the workers until Shutdown is
+// called.
+func (q *Queue) Start() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.started {
+		return ErrQueueStarted
+	}
+	for _, t := range q.types {
+		err := q.r.Client.XGroupCreateMkStream(q.streamKey(t.name), q.config.Group, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return err
+		}
+	}
+	q.started = true
+	q.stop = make(chan struct{})
+	q.loop(q.promote)
+	for _, t := range q.types {
+		t := t
+		q.loop(func() { q.reclaim(t) })
+		for i := 0; i < t.concurrency; i++ {
+			q.loops.Add(1)
+			go q.work(t)
+		}
+	}
+	return nil
+}
+
+// Shutdown stops fetching new jobs and waits for running jobs to finish or
+// ctx to be done.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.started {
+		q.mu.Unlock()
+		return nil
+	}
+	q.started = false
+	close(q.stop)
+	q.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		q.loops.Wait()
+		q.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DeadJobs returns up to count jobs from the dead-letter stream, oldest first.
+func (q *Queue) DeadJobs(count int64) ([]Job, error) {
+	msgs, err := q.r.Client.XRangeN(q.deadKey(), "-", "+", count).Result()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, 0, len(msgs))
+	for _, msg := range msgs {
+		job, err := parseJob(msg)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// RetryDead moves a job from the dead-letter stream back to its queue.
+func (q *Queue) RetryDead(streamID string) error {
+	msgs, err := q.r.Client.XRange(q.deadKey(), streamID, streamID).Result()
+	if err != nil {
+		return err
+	}
+	if len(msgs) == 0 {
+		return redis.Nil
+	}
+	job, err := parseJob(msgs[0])
+	if err != nil {
+		return err
+	}
+	job.Attempt = 0
+	job.Error = ""
+	j, err := json.Marshal(&job)
+	if err != nil {
+		return err
+	}
+	_, err = q.r.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.XAdd(&redis.XAddArgs{Stream: q.streamKey(job.Type), Values: map[string]interface{}{"job": j}})
+		pipe.XDel(q.deadKey(), streamID)
+		return nil
+	})
+	return err
+}
+
+func (q *Queue) loop(fn func()) {
+	q.loops.Add(1)
+	go func() {
+		defer q.loops.Done()
+		ticker := time.NewTicker(q.config.PollInterval)
+		defer ticker.Stop()
+		for {
+			fn()
+			select {
+			case <-q.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (q *Queue) promote() {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if err := queuePromoteScript.Run(q.r.Client, []string{q.delayedKey()}, now, q.streamKey(""), 100).Err(); err != nil {
+		log.Errorln("Queue promote delayed jobs error -:", err)
+	}
+}
+
+// reclaim takes over jobs whose consumer did not ack them within the
+// visibility timeout and hands them to the workers of t.
+func (q *Queue) reclaim(t *jobType) {
+	stream := q.streamKey(t.name)
+	pending, err := q.r.Client.XPendingExt(&redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  q.config.Group,
+		Start:  "-",
+		End:    "+",
+		Count:  100,
+	}).Result()
+	if err != nil {
+		log.Errorln("Queue pending jobs error -:", err)
+		return
+	}
+	var ids []string
+	deliveries := map[string]int64{}
+	for _, p := range pending {
+		if p.Idle >= q.config.VisibilityTimeout {
+			ids = append(ids, p.ID)
+			deliveries[p.ID] = p.RetryCount
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	msgs, err := q.r.Client.XClaim(&redis.XClaimArgs{
+		Stream:   stream,
+		Group:    q.config.Group,
+		Consumer: q.config.Consumer,
+		MinIdle:  q.config.VisibilityTimeout,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		log.Errorln("Queue claim jobs error -:", err)
+		return
+	}
+	for _, msg := range msgs {
+		select {
+		case t.claimed <- claimedJob{msg: msg, deliveries: deliveries[msg.ID]}:
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+func (q *Queue) work(t *jobType) {
+	defer q.loops.Done()
+	stream := q.streamKey(t.name)
+	for {
+		select {
+		case <-q.stop:
+			return
+		case c := <-t.claimed:
+			q.process(t, c.msg, c.deliveries)
+			continue
+		default:
+		}
+		res, err := q.r.Client.XReadGroup(&redis.XReadGroupArgs{
+			Group:    q.config.Group,
+			Consumer: q.config.Consumer,
+			Streams:  []string{stream, ">"},
+			Count:    1,
+			Block:    q.config.PollInterval,
+		}).Result()
+		if err != nil {
+			if err != redis.Nil {
+				log.Errorln("Queue read jobs error -:", err)
+				select {
+				case <-q.stop:
+					return
+				case <-time.After(q.config.PollInterval):
+				}
+			}
+			continue
+		}
+		for _, s := range res {
+			for _, msg := range s.Messages {
+				q.process(t, msg, 0)
+			}
+		}
+	}
+}
+
+// process runs the job of msg, crashed is how many earlier deliveries of the
+// entry died or timed out without an ack. Those count as failed attempts.
+func (q *Queue) process(t *jobType, msg redis.XMessage, crashed int64) {
+	q.inFlight.Add(1)
+	defer q.inFlight.Done()
+	job, err := parseJob(msg)
+	if err != nil {
+		log.Errorln("Queue decode job error -:", err)
+		job = Job{Type: t.name, Error: err.Error(), StreamID: msg.ID}
+		q.bury(t, msg.ID, job)
+		return
+	}
+	// the entry is never rewritten, so the crashes are counted by the
+	// delivery count of the stream instead of the job
+	if job.Attempt+int(crashed) > q.config.MaxRetries {
+		job.Attempt += int(crashed)
+		job.Error = "visibility timeout exceeded"
+		q.bury(t, msg.ID, job)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), q.config.VisibilityTimeout)
+	err = q.run(ctx, t, &job)
+	cancel()
+	if err == nil {
+		q.finish(t, msg.ID, nil)
+		return
+	}
+	job.Attempt += int(crashed) + 1
+	job.Error = err.Error()
+	if job.Attempt > q.config.MaxRetries {
+		q.bury(t, msg.ID, job)
+		return
+	}
+	at := time.Now().Add(q.backoff(job.Attempt))
+	q.finish(t, msg.ID, func(pipe redis.Pipeliner) error {
+		return q.schedule(pipe, job, at)
+	})
+}
+
+func (q *Queue) run(ctx context.Context, t *jobType, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panic: %v", r)
+		}
+	}()
+	return t.handler(ctx, job)
+}
+
+// finish acks and removes the stream entry, fn runs in the same transaction.
+func (q *Queue) finish(t *jobType, id string, fn func(pipe redis.Pipeliner) error) {
+	stream := q.streamKey(t.name)
+	_, err := q.r.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.XAck(stream, q.config.Group, id)
+		pipe.XDel(stream, id)
+		if fn != nil {
+			return fn(pipe)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorln("Queue ack job error -:", err)
+	}
+}
+
+func (q *Queue) bury(t *jobType, id string, job Job) {
+	log.Errorf("Queue job %s (%s) moved to dead-letter -: %s", job.ID, job.Type, job.Error)
+	j, err := json.Marshal(&job)
+	if err != nil {
+		log.Errorln("Queue encode dead job error -:", err)
+		return
+	}
+	q.finish(t, id, func(pipe redis.Pipeliner) error {
+		return pipe.XAdd(&redis.XAddArgs{
+			Stream: q.deadKey(),
+			Values: map[string]interface{}{
+				"job":       j,
+				"failed_at": time.Now().Format(time.RFC3339),
+			},
+		}).Err()
+	})
+}
+
+func (q *Queue) schedule(c redis.Cmdable, job Job, at time.Time) error {
+	j, err := json.Marshal(&job)
+	if err != nil {
+		return err
+	}
+	return c.ZAdd(q.delayedKey(), &redis.Z{
+		Score:  float64(at.UnixNano() / int64(time.Millisecond)),
+		Member: j,
+	}).Err()
+}
+
+func (q *Queue) backoff(attempt int) time.Duration {
+	d := q.config.MinBackoff
+	for i := 1; i < attempt && d < q.config.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > q.config.MaxBackoff {
+		d = q.config.MaxBackoff
+	}
+	return d
+}
+
+func (q *Queue) newJob(jobType string, v interface{}) (Job, error) {
+	payload, err := encodeValue(q.r.codec(), v)
+	if err != nil {
+		return Job{}, err
+	}
+	return Job{
+		ID:         uuid.NewV4().String(),
+		Type:       jobType,
+		Payload:    payload,
+		EnqueuedAt: time.Now(),
+	}, nil
+}
+
+func (q *Queue) streamKey(jobType string) string {
+	return q.r.Key(fmt.Sprintf("queue:%s:jobs:%s", q.name, jobType), nil)
+}
+
+func (q *Queue) delayedKey() string {
+	return q.r.Key(fmt.Sprintf("queue:%s:delayed", q.name), nil)
+}
+
+func (q *Queue) deadKey() string {
+	return q.r.Key(fmt.Sprintf("queue:%s:dead", q.name), nil)
+}
+
+func parseJob(msg redis.XMessage) (Job, error) {
+	var job Job
+	s, ok := msg.Values["job"].(string)
+	if !ok {
+		return job, fmt.Errorf("stream entry %s has no job", msg.ID)
+	}
+	if err := json.Unmarshal([]byte(s), &job); err != nil {
+		return job, err
+	}
+	job.StreamID = msg.ID
+	return job, nil
+}
@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueueMaxRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		runs       int32
+	}{
+		{name: "negative disables retrying", maxRetries: -1, runs: 1},
+		{name: "one retry", maxRetries: 1, runs: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := newTestRedis(t)
+			q := NewQueue(r, "jobs", QueueConfig{
+				MaxRetries:   tt.maxRetries,
+				MinBackoff:   time.Millisecond,
+				MaxBackoff:   time.Millisecond,
+				PollInterval: 10 * time.Millisecond,
+			})
+			var runs int32
+			q.Register("fail", 1, func(ctx context.Context, job *Job) error {
+				atomic.AddInt32(&runs, 1)
+				return errors.New("failed")
+			})
+			if err := q.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = q.Shutdown(context.Background()) }()
+			if _, err := q.Enqueue(context.Background(), "fail", "payload"); err != nil {
+				t.Fatal(err)
+			}
+			var dead []Job
+			deadline := time.Now().Add(5 * time.Second)
+			for len(dead) == 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+				var err error
+				if dead, err = q.DeadJobs(10); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(dead) != 1 {
+				t.Fatalf("dead jobs = %v", dead)
+			}
+			if got := atomic.LoadInt32(&runs); got != tt.runs {
+				t.Errorf("handler ran %d times, want %d", got, tt.runs)
+			}
+			if dead[0].Error != "failed" {
+				t.Errorf("dead job error = %q", dead[0].Error)
+			}
+		})
+	}
+}
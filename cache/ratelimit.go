@@ -0,0 +1,489 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	uuid "github.com/satori/go.uuid"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	FixedWindow RateLimitAlgorithm = iota
+	SlidingWindow
+	TokenBucket
+)
+
+const (
+	HeaderRateLimitLimit     = "X-RateLimit-Limit"
+	HeaderRateLimitRemaining = "X-RateLimit-Remaining"
+	HeaderRateLimitReset     = "X-RateLimit-Reset"
+	HeaderRetryAfter         = "Retry-After"
+)
+
+type RateLimitAlgorithm int
+
+// RateLimiter is implemented by the redis backed limiters and by MemoryLimiter
+// so that code depending on it can be tested without a redis server.
+type RateLimiter interface {
+	Allow(key string) (RateLimitResult, error)
+	AllowN(key string, n int64) (RateLimitResult, error)
+	Reset(key string) error
+}
+
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int64
+	Remaining  int64
+	ResetAt    time.Time
+	RetryAfter time.Duration
+}
+
+// Headers returns the X-RateLimit-* headers (and Retry-After when the request
+// was rejected) describing the result.
+func (r RateLimitResult) Headers() map[string]string {
+	h := map[string]string{
+		HeaderRateLimitLimit:     strconv.FormatInt(r.Limit, 10),
+		HeaderRateLimitRemaining: strconv.FormatInt(r.Remaining, 10),
+		HeaderRateLimitReset:     strconv.FormatInt(r.ResetAt.Unix(), 10),
+	}
+	if !r.Allowed {
+		h[HeaderRetryAfter] = strconv.FormatInt(int64(math.Ceil(r.RetryAfter.Seconds())), 10)
+	}
+	return h
+}
+
+var fixedWindowScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local n = tonumber(ARGV[2])
+local window = tonumber(ARGV[3])
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+if current + n > limit then
+	local ttl = redis.call('PTTL', KEYS[1])
+	if ttl < 0 then ttl = window end
+	return {0, current, ttl}
+end
+current = redis.call('INCRBY', KEYS[1], n)
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+	redis.call('PEXPIRE', KEYS[1], window)
+	ttl = window
+end
+return {1, current, ttl}
+`)
+
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count + n <= limit then
+	for i = 1, n do
+		redis.call('ZADD', KEYS[1], now, ARGV[5] .. ':' .. i)
+	end
+	count = count + n
+	allowed = 1
+end
+local reset = now + window
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window
+end
+if count > 0 then
+	redis.call('PEXPIRE', KEYS[1], window)
+end
+return {allowed, count, reset}
+`)
+
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+local data = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(data[1])
+local ts = tonumber(data[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+if tokens >= n then
+	tokens = tokens - n
+	allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.max(1, math.ceil((capacity - tokens) / rate)))
+return {allowed, tostring(tokens)}
+`)
+
+type FixedWindowLimiter struct {
+	r      *Redis
+	prefix string
+	limit  int64
+	window time.Duration
+}
+
+type SlidingWindowLimiter struct {
+	r      *Redis
+	prefix string
+	limit  int64
+	window time.Duration
+}
+
+type TokenBucketLimiter struct {
+	r        *Redis
+	prefix   string
+	capacity int64
+	interval time.Duration
+}
+
+// NewFixedWindowLimiter allows limit requests per key within each window,
+// the window starts with the first request of the key.
+func NewFixedWindowLimiter(r *Redis, prefix string, limit int64, window time.Duration) *FixedWindowLimiter {
+	return &FixedWindowLimiter{
+		r:      r,
+		prefix: prefix,
+		limit:  limit,
+		window: window,
+	}
+}
+
+// NewSlidingWindowLimiter allows limit requests per key within any window
+// ending now by keeping a log of request timestamps.
+func NewSlidingWindowLimiter(r *Redis, prefix string, limit int64, window time.Duration) *SlidingWindowLimiter {
+	return &SlidingWindowLimiter{
+		r:      r,
+		prefix: prefix,
+		limit:  limit,
+		window: window,
+	}
+}
+
+// NewTokenBucketLimiter holds up to capacity tokens per key and refills one
+// token every interval.
+func NewTokenBucketLimiter(r *Redis, prefix string, capacity int64, interval time.Duration) *TokenBucketLimiter {
+	return &TokenBucketLimiter{
+		r:        r,
+		prefix:   prefix,
+		capacity: capacity,
+		interval: interval,
+	}
+}
+
+func (l *FixedWindowLimiter) Allow(key string) (RateLimitResult, error) {
+	return l.AllowN(key, 1)
+}
+
+func (l *FixedWindowLimiter) AllowN(key string, n int64) (RateLimitResult, error) {
+	now := time.Now()
+	v, err := fixedWindowScript.Run(l.r.Client, []string{l.r.Key(limiterKey(l.prefix, key), nil)}, l.limit, n, ms(l.window)).Result()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	res, err := int64Slice(v, 3)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	ttl := time.Duration(res[2]) * time.Millisecond
+	result := RateLimitResult{
+		Allowed:   res[0] == 1,
+		Limit:     l.limit,
+		Remaining: remaining(l.limit, res[1]),
+		ResetAt:   now.Add(ttl),
+	}
+	if !result.Allowed {
+		result.RetryAfter = ttl
+	}
+	return result, nil
+}
+
+func (l *FixedWindowLimiter) Reset(key string) error {
+	return l.r.Del(limiterKey(l.prefix, key))
+}
+
+func (l *SlidingWindowLimiter) Allow(key string) (RateLimitResult, error) {
+	return l.AllowN(key, 1)
+}
+
+func (l *SlidingWindowLimiter) AllowN(key string, n int64) (RateLimitResult, error) {
+	now := time.Now()
+	v, err := slidingWindowScript.Run(
+		l.r.Client,
+		[]string{l.r.Key(limiterKey(l.prefix, key), nil)},
+		now.UnixNano()/int64(time.Millisecond),
+		ms(l.window),
+		l.limit,
+		n,
+		uuid.NewV4().String(),
+	).Result()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	res, err := int64Slice(v, 3)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	resetAt := time.Unix(0, res[2]*int64(time.Millisecond))
+	result := RateLimitResult{
+		Allowed:   res[0] == 1,
+		Limit:     l.limit,
+		Remaining: remaining(l.limit, res[1]),
+		ResetAt:   resetAt,
+	}
+	if !result.Allowed {
+		result.RetryAfter = resetAt.Sub(now)
+	}
+	return result, nil
+}
+
+func (l *SlidingWindowLimiter) Reset(key string) error {
+	return l.r.Del(limiterKey(l.prefix, key))
+}
+
+func (l *TokenBucketLimiter) Allow(key string) (RateLimitResult, error) {
+	return l.AllowN(key, 1)
+}
+
+func (l *TokenBucketLimiter) AllowN(key string, n int64) (RateLimitResult, error) {
+	now := time.Now()
+	rate := 1 / float64(ms(l.interval))
+	v, err := tokenBucketScript.Run(
+		l.r.Client,
+		[]string{l.r.Key(limiterKey(l.prefix, key), nil)},
+		l.capacity,
+		strconv.FormatFloat(rate, 'f', -1, 64),
+		now.UnixNano()/int64(time.Millisecond),
+		n,
+	).Result()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	arr, ok := v.([]interface{})
+	if !ok || len(arr) != 2 {
+		return RateLimitResult{}, errors.New("unexpected rate limit script result")
+	}
+	allowed, _ := arr[0].(int64)
+	s, _ := arr[1].(string)
+	tokens, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return tokenBucketResult(allowed == 1, l.capacity, l.interval, tokens, n, now), nil
+}
+
+func (l *TokenBucketLimiter) Reset(key string) error {
+	return l.r.Del(limiterKey(l.prefix, key))
+}
+
+// MemoryLimiter is an in-process RateLimiter with the same semantics as the
+// redis limiters. It is meant for tests and single instance deployments.
+// Keys whose window passed or whose bucket refilled are dropped once per
+// window, so memory follows the keys active in the last window.
+type MemoryLimiter struct {
+	algorithm RateLimitAlgorithm
+	limit     int64
+	window    time.Duration
+	now       func() time.Time
+	mu        sync.Mutex
+	prunedAt  time.Time
+	windows   map[string]*memoryWindow
+	logs      map[string][]time.Time
+	buckets   map[string]*memoryBucket
+}
+
+type memoryWindow struct {
+	count   int64
+	resetAt time.Time
+}
+
+type memoryBucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+// NewMemoryLimiter creates an in-memory limiter. For TokenBucket, limit is the
+// bucket capacity and window the refill interval of one token.
+func NewMemoryLimiter(algorithm RateLimitAlgorithm, limit int64, window time.Duration) *MemoryLimiter {
+	return &MemoryLimiter{
+		algorithm: algorithm,
+		limit:     limit,
+		window:    window,
+		now:       time.Now,
+		windows:   map[string]*memoryWindow{},
+		logs:      map[string][]time.Time{},
+		buckets:   map[string]*memoryBucket{},
+	}
+}
+
+// SetClock replaces the time source, it lets tests move time forward.
+func (l *MemoryLimiter) SetClock(now func() time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.now = now
+}
+
+func (l *MemoryLimiter) Allow(key string) (RateLimitResult, error) {
+	return l.AllowN(key, 1)
+}
+
+func (l *MemoryLimiter) AllowN(key string, n int64) (RateLimitResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if !now.Before(l.prunedAt.Add(l.window)) {
+		l.prune(now)
+	}
+	switch l.algorithm {
+	case FixedWindow:
+		return l.fixedWindow(key, n, now), nil
+	case SlidingWindow:
+		return l.slidingWindow(key, n, now), nil
+	case TokenBucket:
+		return l.tokenBucket(key, n, now), nil
+	}
+	return RateLimitResult{}, fmt.Errorf("unknown rate limit algorithm %d", l.algorithm)
+}
+
+func (l *MemoryLimiter) Reset(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.windows, key)
+	delete(l.logs, key)
+	delete(l.buckets, key)
+	return nil
+}
+
+// prune drops the keys that are back to their initial state.
+func (l *MemoryLimiter) prune(now time.Time) {
+	l.prunedAt = now
+	for key, w := range l.windows {
+		if !now.Before(w.resetAt) {
+			delete(l.windows, key)
+		}
+	}
+	for key, log := range l.logs {
+		if len(log) == 0 || !log[len(log)-1].After(now.Add(-l.window)) {
+			delete(l.logs, key)
+		}
+	}
+	for key, b := range l.buckets {
+		if b.tokens+float64(now.Sub(b.ts))/float64(l.window) >= float64(l.limit) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *MemoryLimiter) fixedWindow(key string, n int64, now time.Time) RateLimitResult {
+	w, ok := l.windows[key]
+	if !ok || !now.Before(w.resetAt) {
+		w = &memoryWindow{resetAt: now.Add(l.window)}
+		l.windows[key] = w
+	}
+	result := RateLimitResult{
+		Allowed: w.count+n <= l.limit,
+		Limit:   l.limit,
+		ResetAt: w.resetAt,
+	}
+	if result.Allowed {
+		w.count += n
+	} else {
+		result.RetryAfter = w.resetAt.Sub(now)
+	}
+	result.Remaining = remaining(l.limit, w.count)
+	return result
+}
+
+func (l *MemoryLimiter) slidingWindow(key string, n int64, now time.Time) RateLimitResult {
+	log := l.logs[key][:0]
+	for _, t := range l.logs[key] {
+		if t.After(now.Add(-l.window)) {
+			log = append(log, t)
+		}
+	}
+	result := RateLimitResult{
+		Allowed: int64(len(log))+n <= l.limit,
+		Limit:   l.limit,
+	}
+	if result.Allowed {
+		for i := int64(0); i < n; i++ {
+			log = append(log, now)
+		}
+	}
+	l.logs[key] = log
+	result.ResetAt = now.Add(l.window)
+	if len(log) > 0 {
+		result.ResetAt = log[0].Add(l.window)
+	}
+	if !result.Allowed {
+		result.RetryAfter = result.ResetAt.Sub(now)
+	}
+	result.Remaining = remaining(l.limit, int64(len(log)))
+	return result
+}
+
+func (l *MemoryLimiter) tokenBucket(key string, n int64, now time.Time) RateLimitResult {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(l.limit), ts: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.ts); elapsed > 0 {
+		b.tokens = math.Min(float64(l.limit), b.tokens+float64(elapsed)/float64(l.window))
+	}
+	b.ts = now
+	allowed := b.tokens >= float64(n)
+	if allowed {
+		b.tokens -= float64(n)
+	}
+	return tokenBucketResult(allowed, l.limit, l.window, b.tokens, n, now)
+}
+
+func tokenBucketResult(allowed bool, capacity int64, interval time.Duration, tokens float64, n int64, now time.Time) RateLimitResult {
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     capacity,
+		Remaining: int64(math.Floor(tokens)),
+		ResetAt:   now.Add(time.Duration((float64(capacity) - tokens) * float64(interval))),
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration((float64(n) - tokens) * float64(interval))
+	}
+	return result
+}
+
+func limiterKey(prefix string, key string) string {
+	return fmt.Sprintf("%s:%s", prefix, key)
+}
+
+func remaining(limit int64, used int64) int64 {
+	if used >= limit {
+		return 0
+	}
+	return limit - used
+}
+
+func ms(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+func int64Slice(v interface{}, n int) ([]int64, error) {
+	arr, ok := v.([]interface{})
+	if !ok || len(arr) != n {
+		return nil, errors.New("unexpected rate limit script result")
+	}
+	res := make([]int64, n)
+	for i, item := range arr {
+		if res[i], ok = item.(int64); !ok {
+			return nil, errors.New("unexpected rate limit script result")
+		}
+	}
+	return res, nil
+}
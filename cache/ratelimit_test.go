@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	type step struct {
+		advance    time.Duration
+		n          int64
+		allowed    bool
+		remaining  int64
+		retryAfter time.Duration
+	}
+	tests := []struct {
+		name      string
+		algorithm RateLimitAlgorithm
+		limit     int64
+		window    time.Duration
+		steps     []step
+	}{
+		{
+			name:      "fixed window",
+			algorithm: FixedWindow,
+			limit:     3,
+			window:    time.Minute,
+			steps: []step{
+				{n: 1, allowed: true, remaining: 2},
+				{advance: 10 * time.Second, n: 2, allowed: true, remaining: 0},
+				{advance: 20 * time.Second, n: 1, allowed: false, remaining: 0, retryAfter: 30 * time.Second},
+				{advance: 30 * time.Second, n: 1, allowed: true, remaining: 2},
+			},
+		},
+		{
+			name:      "fixed window rejects more than the limit",
+			algorithm: FixedWindow,
+			limit:     2,
+			window:    time.Minute,
+			steps: []step{
+				{n: 3, allowed: false, remaining: 2, retryAfter: time.Minute},
+				{n: 2, allowed: true, remaining: 0},
+			},
+		},
+		{
+			name:      "sliding window",
+			algorithm: SlidingWindow,
+			limit:     2,
+			window:    time.Minute,
+			steps: []step{
+				{n: 1, allowed: true, remaining: 1},
+				{advance: 30 * time.Second, n: 1, allowed: true, remaining: 0},
+				{advance: 20 * time.Second, n: 1, allowed: false, remaining: 0, retryAfter: 10 * time.Second},
+				// the first request left the window, the second did not
+				{advance: 11 * time.Second, n: 1, allowed: true, remaining: 0},
+				{advance: 20 * time.Second, n: 1, allowed: false, remaining: 0, retryAfter: 9 * time.Second},
+				{advance: 10 * time.Second, n: 1, allowed: true, remaining: 0},
+			},
+		},
+		{
+			name:      "token bucket",
+			algorithm: TokenBucket,
+			limit:     2,
+			window:    time.Second,
+			steps: []step{
+				{n: 2, allowed: true, remaining: 0},
+				{n: 1, allowed: false, remaining: 0, retryAfter: time.Second},
+				{advance: 500 * time.Millisecond, n: 1, allowed: false, remaining: 0, retryAfter: 500 * time.Millisecond},
+				{advance: 500 * time.Millisecond, n: 1, allowed: true, remaining: 0},
+				// refills up to the capacity only
+				{advance: time.Minute, n: 1, allowed: true, remaining: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+			l := NewMemoryLimiter(tt.algorithm, tt.limit, tt.window)
+			l.SetClock(func() time.Time { return now })
+			for i, s := range tt.steps {
+				now = now.Add(s.advance)
+				got, err := l.AllowN("k", s.n)
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if got.Allowed != s.allowed || got.Remaining != s.remaining || got.RetryAfter != s.retryAfter {
+					t.Errorf("step %d: got allowed=%v remaining=%d retry=%v, want allowed=%v remaining=%d retry=%v",
+						i, got.Allowed, got.Remaining, got.RetryAfter, s.allowed, s.remaining, s.retryAfter)
+				}
+				if got.Limit != tt.limit {
+					t.Errorf("step %d: limit = %d, want %d", i, got.Limit, tt.limit)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryLimiterReset(t *testing.T) {
+	for _, algorithm := range []RateLimitAlgorithm{FixedWindow, SlidingWindow, TokenBucket} {
+		l := NewMemoryLimiter(algorithm, 1, time.Minute)
+		if res, _ := l.Allow("k"); !res.Allowed {
+			t.Fatalf("algorithm %d: first request rejected", algorithm)
+		}
+		if res, _ := l.Allow("other"); !res.Allowed {
+			t.Fatalf("algorithm %d: keys are not independent", algorithm)
+		}
+		if res, _ := l.Allow("k"); res.Allowed {
+			t.Fatalf("algorithm %d: request over the limit allowed", algorithm)
+		}
+		if err := l.Reset("k"); err != nil {
+			t.Fatal(err)
+		}
+		if res, _ := l.Allow("k"); !res.Allowed {
+			t.Errorf("algorithm %d: request after reset rejected", algorithm)
+		}
+	}
+}
+
+func TestMemoryLimiterUnknownAlgorithm(t *testing.T) {
+	if _, err := NewMemoryLimiter(RateLimitAlgorithm(99), 1, time.Second).Allow("k"); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
+
+func TestRateLimitResultHeaders(t *testing.T) {
+	reset := time.Unix(1600000000, 0)
+	h := RateLimitResult{Allowed: false, Limit: 10, ResetAt: reset, RetryAfter: 1500 * time.Millisecond}.Headers()
+	want := map[string]string{
+		HeaderRateLimitLimit:     "10",
+		HeaderRateLimitRemaining: "0",
+		HeaderRateLimitReset:     "1600000000",
+		HeaderRetryAfter:         "2",
+	}
+	for k, v := range want {
+		if h[k] != v {
+			t.Errorf("%s = %q, want %q", k, h[k], v)
+		}
+	}
+	if _, ok := (RateLimitResult{Allowed: true}).Headers()[HeaderRetryAfter]; ok {
+		t.Error("Retry-After set on an allowed request")
+	}
+}
+
+func TestMemoryLimiterPrune(t *testing.T) {
+	for _, algorithm := range []RateLimitAlgorithm{FixedWindow, SlidingWindow, TokenBucket} {
+		now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+		l := NewMemoryLimiter(algorithm, 2, time.Second)
+		l.SetClock(func() time.Time { return now })
+		for _, key := range []string{"a", "b", "c"} {
+			if _, err := l.Allow(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		now = now.Add(500 * time.Millisecond)
+		_, _ = l.Allow("a")
+		// every window passed and every bucket refilled
+		now = now.Add(2 * time.Second)
+		_, _ = l.Allow("d")
+		keys := len(l.windows) + len(l.logs) + len(l.buckets)
+		if keys != 1 {
+			t.Errorf("algorithm %d: %d keys kept, want 1", algorithm, keys)
+		}
+	}
+}
@@ -1,14 +1,26 @@
 package cache
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/go-redis/redis/v7"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Redis struct {
 	Client *redis.Client
+	Codec  Codec
+	// Prefix namespaces every key and channel, so services can share a db.
+	Prefix  string
+	schemas *schemaRegistry
+	hooks   []Hook
+}
+
+type schemaRegistry struct {
+	mu       sync.RWMutex
+	versions map[reflect.Type]int
 }
 
 func New(host string, port string, db int) Redis {
@@ -18,6 +30,8 @@ func New(host string, port string, db int) Redis {
 			Password: "",
 			DB:       db,
 		}),
+		Codec:   JSON,
+		schemas: &schemaRegistry{versions: map[reflect.Type]int{}},
 	}
 }
 
@@ -28,39 +42,89 @@ func (r *Redis) Ping() error {
 	return nil
 }
 
+func (r *Redis) SetCodec(c Codec) {
+	r.Codec = c
+}
+
+func (r *Redis) SetPrefix(prefix string) {
+	r.Prefix = prefix
+}
+
+// RegisterSchema bakes version into the keys of every value of v's type.
+// Bump it when the struct changes shape so old entries are no longer read.
+func (r *Redis) RegisterSchema(v interface{}, version int) {
+	if r.schemas == nil {
+		r.schemas = &schemaRegistry{versions: map[reflect.Type]int{}}
+	}
+	r.schemas.mu.Lock()
+	defer r.schemas.mu.Unlock()
+	r.schemas.versions[schemaType(v)] = version
+}
+
+// Key returns the redis key used for key and a value like v, v may be nil
+// for keys without a typed value. Use it when accessing Client directly.
+func (r *Redis) Key(key string, v interface{}) string {
+	if r.Prefix != "" {
+		key = fmt.Sprintf("%s:%s", r.Prefix, key)
+	}
+	if v == nil || r.schemas == nil {
+		return key
+	}
+	r.schemas.mu.RLock()
+	version, ok := r.schemas.versions[schemaType(v)]
+	r.schemas.mu.RUnlock()
+	if ok {
+		key = fmt.Sprintf("%s:v%d", key, version)
+	}
+	return key
+}
+
 func (r *Redis) Set(key string, v interface{}, timeout time.Duration) error {
-	j, err := json.Marshal(&v)
+	return r.SetWithCodec(key, v, timeout, r.codec())
+}
+
+func (r *Redis) SetWithCodec(key string, v interface{}, timeout time.Duration, c Codec) (err error) {
+	defer r.observe("set", key, time.Now(), 0, 0, &err)
+	b, err := encodeValue(c, v)
 	if err != nil {
 		return err
 	}
-	if _, err = r.Client.Set(key, j, timeout).Result(); err != nil {
+	if _, err = r.Client.Set(r.Key(key, v), b, timeout).Result(); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (r *Redis) Get(key string, v interface{}) error {
-	b, err := r.Client.Get(key).Bytes()
+func (r *Redis) Get(key string, v interface{}) (err error) {
+	defer r.observe("get", key, time.Now(), 1, 0, &err)
+	b, err := r.Client.Get(r.Key(key, v)).Bytes()
 	if err != nil {
 		return err
 	}
 	if v != nil {
-		if err := json.Unmarshal(b, v); err != nil {
+		if err := decodeValue(b, v); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (r *Redis) Del(key string) error {
-	return r.Client.Del(key).Err()
+// Del removes key, pass a value like v to remove a key stored with a
+// registered schema version.
+func (r *Redis) Del(key string, v ...interface{}) (err error) {
+	defer r.observe("del", key, time.Now(), 0, 0, &err)
+	return r.Client.Del(r.Key(key, first(v))).Err()
 }
 
-func (r *Redis) DelPattern(key string) error {
-	keys, err := r.Client.Keys(key).Result()
+func (r *Redis) DelPattern(key string) (err error) {
+	defer r.observe("del_pattern", key, time.Now(), 0, 0, &err)
+	keys, err := r.Client.Keys(r.Key(key, nil)).Result()
 	if err != nil {
 		return err
 	}
+	if len(keys) == 0 {
+		return nil
+	}
 	return r.Client.Del(keys...).Err()
 }
 
@@ -74,3 +138,26 @@ func (r *Redis) IsKeyNotFound(err error) bool {
 	}
 	return false
 }
+
+func (r *Redis) codec() Codec {
+	if r.Codec == nil {
+		return JSON
+	}
+	return r.Codec
+}
+
+// unprefix turns a redis key or channel back into the name used by callers.
+func (r *Redis) unprefix(key string) string {
+	if r.Prefix == "" {
+		return key
+	}
+	return strings.TrimPrefix(key, r.Prefix+":")
+}
+
+func schemaType(v interface{}) reflect.Type {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,22 @@
+package cache
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"testing"
+)
+
+// newTestRedis returns a Redis backed by an in-process redis stub, the stub
+// is returned too so tests can move its clock.
+func newTestRedis(t *testing.T) (*Redis, *miniredis.Miniredis) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	r := New("", "", 0)
+	r.Client = redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { _ = r.Client.Close() })
+	r.SetPrefix("test")
+	return &r, m
+}
@@ -0,0 +1,415 @@
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v7"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultSessionCookieName = "session"
+	DefaultSessionMaxAge     = 24 * time.Hour
+	DefaultSessionKeyPrefix  = "session"
+	SessionContextKey        = "_session"
+)
+
+var ErrInvalidSessionCookie = errors.New("invalid session cookie")
+
+type SessionConfig struct {
+	CookieName string
+	// Secret signs the session id in the cookie, it is required.
+	Secret []byte
+	// EncryptionKey, when set, encrypts the session id with AES-GCM instead
+	// of only signing it. It must be 16, 24 or 32 bytes.
+	EncryptionKey []byte
+	// MaxAge is the idle timeout, every request extends it again.
+	MaxAge    time.Duration
+	KeyPrefix string
+	Path      string
+	Domain    string
+	Secure    bool
+	SameSite  http.SameSite
+}
+
+type SessionManager struct {
+	r      *Redis
+	config SessionConfig
+	aead   cipher.AEAD
+}
+
+type Session struct {
+	ID        string                     `json:"-"`
+	UserID    string                     `json:"user_id,omitempty"`
+	Data      map[string]json.RawMessage `json:"data"`
+	CreatedAt time.Time                  `json:"created_at"`
+	UpdatedAt time.Time                  `json:"updated_at"`
+	m         *SessionManager
+	w         http.ResponseWriter
+	isNew     bool
+	modified  bool
+	destroyed bool
+}
+
+func NewSessionManager(r *Redis, config SessionConfig) (*SessionManager, error) {
+	if len(config.Secret) == 0 {
+		return nil, errors.New("session secret is required")
+	}
+	if config.CookieName == "" {
+		config.CookieName = DefaultSessionCookieName
+	}
+	if config.MaxAge <= 0 {
+		config.MaxAge = DefaultSessionMaxAge
+	}
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = DefaultSessionKeyPrefix
+	}
+	if config.Path == "" {
+		config.Path = "/"
+	}
+	if config.SameSite == 0 {
+		config.SameSite = http.SameSiteLaxMode
+	}
+	m := &SessionManager{r: r, config: config}
+	if len(config.EncryptionKey) > 0 {
+		block, err := aes.NewCipher(config.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		if m.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Load returns the session of the request or a new empty session when the
+// request has no valid session cookie. w receives the session cookie.
+func (m *SessionManager) Load(w http.ResponseWriter, req *http.Request) (*Session, error) {
+	cookie, err := req.Cookie(m.config.CookieName)
+	if err == nil {
+		if id, err := m.decodeCookie(cookie.Value); err == nil {
+			s := &Session{ID: id, m: m, w: w}
+			err := m.r.Get(m.sessionKey(id), s)
+			if err == nil {
+				if s.Data == nil {
+					s.Data = map[string]json.RawMessage{}
+				}
+				m.setCookie(w, id)
+				return s, nil
+			}
+			if !m.r.IsKeyNotFound(err) {
+				return nil, err
+			}
+		}
+	}
+	return m.newSession(w)
+}
+
+// Save persists the session data and extends its expiry.
+func (m *SessionManager) Save(s *Session) error {
+	if s.destroyed {
+		return nil
+	}
+	if !s.modified && s.isNew {
+		return nil
+	}
+	if s.modified {
+		s.UpdatedAt = time.Now()
+		if err := m.r.Set(m.sessionKey(s.ID), s, m.config.MaxAge); err != nil {
+			return err
+		}
+	}
+	_, err := m.r.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		if !s.modified {
+			pipe.Expire(m.redisKey(s.ID), m.config.MaxAge)
+		}
+		if s.UserID != "" {
+			pipe.SAdd(m.userKey(s.UserID), s.ID)
+			pipe.Expire(m.userKey(s.UserID), m.config.MaxAge)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.isNew = false
+	s.modified = false
+	return nil
+}
+
+// RevokeUser destroys every session belonging to userID.
+func (m *SessionManager) RevokeUser(userID string) error {
+	ids, err := m.r.Client.SMembers(m.userKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(ids)+1)
+	for _, id := range ids {
+		keys = append(keys, m.redisKey(id))
+	}
+	keys = append(keys, m.userKey(userID))
+	return m.r.Client.Del(keys...).Err()
+}
+
+// UserSessions returns the ids of the live sessions of userID.
+func (m *SessionManager) UserSessions(userID string) ([]string, error) {
+	ids, err := m.r.Client.SMembers(m.userKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	live := ids[:0]
+	for _, id := range ids {
+		n, err := m.r.Client.Exists(m.redisKey(id)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			live = append(live, id)
+		} else {
+			_ = m.r.Client.SRem(m.userKey(userID), id).Err()
+		}
+	}
+	return live, nil
+}
+
+func (m *SessionManager) EchoMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			s, err := m.Load(c.Response(), c.Request())
+			if err != nil {
+				return err
+			}
+			c.Set(SessionContextKey, s)
+			err = next(c)
+			if err := m.Save(s); err != nil {
+				log.Errorln("Session save error -:", err)
+			}
+			return err
+		}
+	}
+}
+
+func (m *SessionManager) GinMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s, err := m.Load(c.Writer, c.Request)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.Set(SessionContextKey, s)
+		c.Next()
+		if err := m.Save(s); err != nil {
+			log.Errorln("Session save error -:", err)
+		}
+	}
+}
+
+// EchoSession returns the session loaded by EchoMiddleware.
+func EchoSession(c echo.Context) *Session {
+	s, _ := c.Get(SessionContextKey).(*Session)
+	return s
+}
+
+// GinSession returns the session loaded by GinMiddleware.
+func GinSession(c *gin.Context) *Session {
+	v, _ := c.Get(SessionContextKey)
+	s, _ := v.(*Session)
+	return s
+}
+
+func (s *Session) Get(key string, v interface{}) error {
+	raw, ok := s.Data[key]
+	if !ok {
+		return redis.Nil
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func (s *Session) Set(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.Data[key] = raw
+	s.touch()
+	return nil
+}
+
+func (s *Session) Delete(key string) {
+	delete(s.Data, key)
+	s.touch()
+}
+
+// Regenerate moves the session to a new id owned by userID, call it after a
+// successful login to prevent session fixation.
+func (s *Session) Regenerate(userID string) error {
+	oldID, oldUser := s.ID, s.UserID
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+	if !s.isNew {
+		_, err := s.m.r.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Del(s.m.redisKey(oldID))
+			if oldUser != "" {
+				pipe.SRem(s.m.userKey(oldUser), oldID)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	s.ID = id
+	s.UserID = userID
+	s.isNew = true
+	s.modified = false
+	s.touch()
+	return nil
+}
+
+// Destroy deletes the session and expires the cookie.
+func (s *Session) Destroy() error {
+	s.destroyed = true
+	http.SetCookie(s.w, &http.Cookie{
+		Name:     s.m.config.CookieName,
+		Value:    "",
+		Path:     s.m.config.Path,
+		Domain:   s.m.config.Domain,
+		MaxAge:   -1,
+		Secure:   s.m.config.Secure,
+		HttpOnly: true,
+		SameSite: s.m.config.SameSite,
+	})
+	_, err := s.m.r.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(s.m.redisKey(s.ID))
+		if s.UserID != "" {
+			pipe.SRem(s.m.userKey(s.UserID), s.ID)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *Session) IsNew() bool {
+	return s.isNew
+}
+
+func (s *Session) touch() {
+	if s.isNew && !s.modified {
+		// the cookie of a new session is only sent once it holds data
+		s.m.setCookie(s.w, s.ID)
+	}
+	s.modified = true
+}
+
+func (m *SessionManager) newSession(w http.ResponseWriter) (*Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &Session{
+		ID:        id,
+		Data:      map[string]json.RawMessage{},
+		CreatedAt: now,
+		UpdatedAt: now,
+		m:         m,
+		w:         w,
+		isNew:     true,
+	}, nil
+}
+
+func (m *SessionManager) setCookie(w http.ResponseWriter, id string) {
+	value, err := m.encodeCookie(id)
+	if err != nil {
+		log.Errorln("Session cookie encode error -:", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.config.CookieName,
+		Value:    value,
+		Path:     m.config.Path,
+		Domain:   m.config.Domain,
+		MaxAge:   int(m.config.MaxAge.Seconds()),
+		Secure:   m.config.Secure,
+		HttpOnly: true,
+		SameSite: m.config.SameSite,
+	})
+}
+
+func (m *SessionManager) encodeCookie(id string) (string, error) {
+	if m.aead != nil {
+		nonce := make([]byte, m.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		sealed := m.aead.Seal(nonce, nonce, []byte(id), []byte(m.config.CookieName))
+		return base64.RawURLEncoding.EncodeToString(sealed), nil
+	}
+	return fmt.Sprintf("%s.%s", id, m.sign(id)), nil
+}
+
+func (m *SessionManager) decodeCookie(value string) (string, error) {
+	if m.aead != nil {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(b) < m.aead.NonceSize() {
+			return "", ErrInvalidSessionCookie
+		}
+		n := m.aead.NonceSize()
+		id, err := m.aead.Open(nil, b[:n], b[n:], []byte(m.config.CookieName))
+		if err != nil {
+			return "", ErrInvalidSessionCookie
+		}
+		return string(id), nil
+	}
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", ErrInvalidSessionCookie
+	}
+	id, sig := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(m.sign(id))) {
+		return "", ErrInvalidSessionCookie
+	}
+	return id, nil
+}
+
+func (m *SessionManager) sign(id string) string {
+	mac := hmac.New(sha256.New, m.config.Secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (m *SessionManager) sessionKey(id string) string {
+	return fmt.Sprintf("%s:%s", m.config.KeyPrefix, id)
+}
+
+// redisKey is the key of the session as stored by Redis.Set.
+func (m *SessionManager) redisKey(id string) string {
+	return m.r.Key(m.sessionKey(id), (*Session)(nil))
+}
+
+func (m *SessionManager) userKey(userID string) string {
+	return m.r.Key(fmt.Sprintf("%s:user:%s", m.config.KeyPrefix, userID), nil)
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+)
+
+const (
+	HeaderCacheStatus = "X-Cache-Status"
+	HeaderAge         = "Age"
+	// swrRetryBackoff is the wait after the first failed refresh, it doubles
+	// with every failure up to the soft TTL.
+	swrRetryBackoff = time.Second
+)
+
+const (
+	CacheHit   = "HIT"
+	CacheStale = "STALE"
+	CacheMiss  = "MISS"
+)
+
+type Loader func() (interface{}, error)
+
+var keepTTLSetScript = redis.NewScript(`
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ttl)
+end
+return ttl
+`)
+
+// FetchResult tells how Fetch answered. Err holds the last refresh error
+// while stale data is being served.
+type FetchResult struct {
+	Status     string
+	Stale      bool
+	Refreshing bool
+	StoredAt   time.Time
+	Err        error
+}
+
+// Headers returns X-Cache-Status and Age describing the result.
+func (f FetchResult) Headers() map[string]string {
+	h := map[string]string{HeaderCacheStatus: f.Status}
+	if !f.StoredAt.IsZero() {
+		h[HeaderAge] = strconv.FormatInt(int64(time.Since(f.StoredAt).Seconds()), 10)
+	}
+	return h
+}
+
+type swrEntry struct {
+	Data       []byte `json:"data"`
+	StoredAt   int64  `json:"stored_at"`
+	SoftExpire int64  `json:"soft_expire"`
+	LastError  string `json:"last_error,omitempty"`
+	Failures   int    `json:"failures,omitempty"`
+}
+
+// Fetch reads key into v and calls loader when it is missing. An entry
+// older than softTTL is still returned, marked stale, while a single
+// background refresh runs across all replicas. When the refresh fails the
+// stale entry keeps being served until hardTTL.
+func (r *Redis) Fetch(key string, v interface{}, softTTL time.Duration, hardTTL time.Duration, loader Loader) (result FetchResult, err error) {
+	start := time.Now()
+	defer func() {
+		if result.Status == CacheMiss {
+			r.observe("fetch", key, start, 0, 1, &err)
+		} else {
+			r.observe("fetch", key, start, 1, 0, &err)
+		}
+	}()
+	return r.fetch(key, v, softTTL, hardTTL, loader)
+}
+
+func (r *Redis) fetch(key string, v interface{}, softTTL time.Duration, hardTTL time.Duration, loader Loader) (FetchResult, error) {
+	if hardTTL < softTTL {
+		hardTTL = softTTL
+	}
+	redisKey := r.Key(key, v)
+	var entry swrEntry
+	b, err := r.Client.Get(redisKey).Bytes()
+	if err != nil && !r.IsKeyNotFound(err) {
+		return FetchResult{}, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return FetchResult{}, err
+		}
+		if err := decodeValue(entry.Data, v); err != nil {
+			return FetchResult{}, err
+		}
+		result := FetchResult{
+			Status:   CacheHit,
+			StoredAt: time.Unix(0, entry.StoredAt*int64(time.Millisecond)),
+		}
+		if entry.LastError != "" {
+			result.Err = errors.New(entry.LastError)
+		}
+		if time.Now().UnixNano()/int64(time.Millisecond) < entry.SoftExpire {
+			return result, nil
+		}
+		result.Status = CacheStale
+		result.Stale = true
+		result.Refreshing = r.refresh(redisKey, entry, softTTL, hardTTL, loader)
+		return result, nil
+	}
+	data, err := r.load(redisKey, softTTL, hardTTL, loader)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	if err := decodeValue(data, v); err != nil {
+		return FetchResult{}, err
+	}
+	return FetchResult{Status: CacheMiss, StoredAt: time.Now()}, nil
+}
+
+func (r *Redis) load(redisKey string, softTTL time.Duration, hardTTL time.Duration, loader Loader) ([]byte, error) {
+	value, err := loader()
+	if err != nil {
+		return nil, err
+	}
+	data, err := encodeValue(r.codec(), value)
+	if err != nil {
+		return nil, err
+	}
+	return data, r.storeEntry(redisKey, swrEntry{Data: data}, softTTL, hardTTL)
+}
+
+// refresh starts a background reload unless another replica already does.
+// After a failure the lock is kept for a backoff, so a failing loader is not
+// called again by every request.
+func (r *Redis) refresh(redisKey string, stale swrEntry, softTTL time.Duration, hardTTL time.Duration, loader Loader) bool {
+	lockKey := redisKey + ":refresh"
+	ok, err := r.Client.SetNX(lockKey, 1, softTTL+time.Minute).Result()
+	if err != nil || !ok {
+		return false
+	}
+	go func() {
+		if err := r.reload(redisKey, softTTL, hardTTL, loader); err != nil {
+			log.Errorf("Cache refresh %s error -: %v", redisKey, err)
+			stale.LastError = err.Error()
+			stale.Failures++
+			// keep serving the stale value, only remember the failure
+			if j, err := json.Marshal(&stale); err == nil {
+				_ = keepTTLSetScript.Run(r.Client, []string{redisKey}, j).Err()
+			}
+			_ = r.Client.PExpire(lockKey, refreshBackoff(stale.Failures, softTTL)).Err()
+			return
+		}
+		r.Client.Del(lockKey)
+	}()
+	return true
+}
+
+// reload runs the background load, a panicking loader is reported as a failed
+// refresh instead of crashing the process.
+func (r *Redis) reload(redisKey string, softTTL time.Duration, hardTTL time.Duration, loader Loader) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("loader panic: %v", p)
+		}
+	}()
+	_, err = r.load(redisKey, softTTL, hardTTL, loader)
+	return err
+}
+
+func refreshBackoff(failures int, softTTL time.Duration) time.Duration {
+	d := swrRetryBackoff
+	for i := 1; i < failures && d < softTTL; i++ {
+		d *= 2
+	}
+	if d > softTTL && softTTL >= swrRetryBackoff {
+		d = softTTL
+	}
+	return d
+}
+
+func (r *Redis) storeEntry(redisKey string, entry swrEntry, softTTL time.Duration, hardTTL time.Duration) error {
+	now := time.Now()
+	entry.StoredAt = now.UnixNano() / int64(time.Millisecond)
+	entry.SoftExpire = now.Add(softTTL).UnixNano() / int64(time.Millisecond)
+	entry.LastError = ""
+	j, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	return r.Client.Set(redisKey, j, hardTTL).Err()
+}
@@ -0,0 +1,34 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFetchRefreshPanic(t *testing.T) {
+	r, _ := newTestRedis(t)
+	var v string
+	if _, err := r.Fetch("k", &v, time.Second, time.Minute, func() (interface{}, error) { return "old", nil }); err != nil {
+		t.Fatal(err)
+	}
+	// the soft expiry is checked against the wall clock
+	time.Sleep(1100 * time.Millisecond)
+	res, err := r.Fetch("k", &v, time.Second, time.Minute, func() (interface{}, error) { panic("boom") })
+	if err != nil || !res.Stale || !res.Refreshing || v != "old" {
+		t.Fatalf("Fetch = %+v, %q, %v", res, v, err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		res, err = r.Fetch("k", &v, time.Second, time.Minute, func() (interface{}, error) { return "new", nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Err != nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if res.Err == nil || res.Err.Error() != "loader panic: boom" || res.Refreshing || v != "old" {
+		t.Errorf("Fetch after panic = %+v, %q", res, v)
+	}
+}
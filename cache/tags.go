@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	"time"
+)
+
+const TagKeyPrefix = "tag"
+
+type taggedValue struct {
+	Tags map[string]int64 `json:"tags"`
+	Data []byte           `json:"data"`
+}
+
+// adds a member to the member set of a tag, the set lives as long as its
+// longest lived member and persists once a member has no timeout
+var tagMemberScript = redis.NewScript(`
+local ttl = tonumber(ARGV[2])
+local existed = redis.call('EXISTS', KEYS[1])
+redis.call('SADD', KEYS[1], ARGV[1])
+if ttl == 0 then
+	redis.call('PERSIST', KEYS[1])
+	return 1
+end
+if existed == 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+	return 1
+end
+local current = redis.call('PTTL', KEYS[1])
+if current >= 0 and current < ttl then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`)
+
+// SetWithTags stores v like Set and remembers the current version of every
+// tag, the value is treated as missing by GetTagged once any of its tags got
+// invalidated.
+func (r *Redis) SetWithTags(key string, v interface{}, timeout time.Duration, tags ...string) (err error) {
+	defer r.observe("set_tagged", key, time.Now(), 0, 0, &err)
+	key = r.Key(key, v)
+	versions, err := r.tagVersions(tags)
+	if err != nil {
+		return err
+	}
+	data, err := encodeValue(r.codec(), v)
+	if err != nil {
+		return err
+	}
+	j, err := json.Marshal(&taggedValue{Tags: versions, Data: data})
+	if err != nil {
+		return err
+	}
+	if err := r.Client.Set(key, j, timeout).Err(); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := tagMemberScript.Run(r.Client, []string{r.tagMembersKey(tag)}, key, ms(timeout)).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetTagged reads a value stored by SetWithTags. It returns redis.Nil, so
+// IsKeyNotFound reports true, when the key is missing or one of its tags was
+// invalidated after the value had been stored.
+func (r *Redis) GetTagged(key string, v interface{}) (err error) {
+	defer r.observe("get_tagged", key, time.Now(), 1, 0, &err)
+	b, err := r.Client.Get(r.Key(key, v)).Bytes()
+	if err != nil {
+		return err
+	}
+	var tv taggedValue
+	if err := json.Unmarshal(b, &tv); err != nil {
+		return err
+	}
+	tags := make([]string, 0, len(tv.Tags))
+	for tag := range tv.Tags {
+		tags = append(tags, tag)
+	}
+	versions, err := r.tagVersions(tags)
+	if err != nil {
+		return err
+	}
+	for tag, ver := range tv.Tags {
+		if versions[tag] != ver {
+			return redis.Nil
+		}
+	}
+	if v != nil {
+		return decodeValue(tv.Data, v)
+	}
+	return nil
+}
+
+// InvalidateTags bumps the version of every tag so all values stored with any
+// of them become stale. The cost depends on the number of tags only, the
+// stale values themselves expire with their own timeout.
+func (r *Redis) InvalidateTags(tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	_, err := r.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, tag := range tags {
+			pipe.Incr(r.tagVersionKey(tag))
+			pipe.Unlink(r.tagMembersKey(tag))
+		}
+		return nil
+	})
+	return err
+}
+
+// TagMembers returns the redis keys currently recorded for tag.
+func (r *Redis) TagMembers(tag string) ([]string, error) {
+	return r.Client.SMembers(r.tagMembersKey(tag)).Result()
+}
+
+// CollectTagGarbage removes keys which have already expired or been deleted
+// from the member sets of the given tags and returns how many were removed.
+func (r *Redis) CollectTagGarbage(tags ...string) (int64, error) {
+	var removed int64
+	for _, tag := range tags {
+		setKey := r.tagMembersKey(tag)
+		var cursor uint64
+		for {
+			keys, next, err := r.Client.SScan(setKey, cursor, "", 100).Result()
+			if err != nil {
+				return removed, err
+			}
+			if len(keys) > 0 {
+				cmds := make([]*redis.IntCmd, len(keys))
+				pipe := r.Client.Pipeline()
+				for i, key := range keys {
+					cmds[i] = pipe.Exists(key)
+				}
+				if _, err := pipe.Exec(); err != nil {
+					return removed, err
+				}
+				var stale []interface{}
+				for i, cmd := range cmds {
+					if cmd.Val() == 0 {
+						stale = append(stale, keys[i])
+					}
+				}
+				if len(stale) > 0 {
+					n, err := r.Client.SRem(setKey, stale...).Result()
+					if err != nil {
+						return removed, err
+					}
+					removed += n
+				}
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+	}
+	return removed, nil
+}
+
+func (r *Redis) tagVersions(tags []string) (map[string]int64, error) {
+	versions := make(map[string]int64, len(tags))
+	if len(tags) == 0 {
+		return versions, nil
+	}
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = r.tagVersionKey(tag)
+	}
+	values, err := r.Client.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, tag := range tags {
+		versions[tag] = 0
+		if s, ok := values[i].(string); ok {
+			var ver int64
+			if _, err := fmt.Sscan(s, &ver); err != nil {
+				return nil, err
+			}
+			versions[tag] = ver
+		}
+	}
+	return versions, nil
+}
+
+func (r *Redis) tagVersionKey(tag string) string {
+	return r.Key(fmt.Sprintf("%s:%s:version", TagKeyPrefix, tag), nil)
+}
+
+func (r *Redis) tagMembersKey(tag string) string {
+	return r.Key(fmt.Sprintf("%s:%s:keys", TagKeyPrefix, tag), nil)
+}
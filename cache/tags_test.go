@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTagMembersExpire(t *testing.T) {
+	r, m := newTestRedis(t)
+	setKey := r.tagMembersKey("user:1")
+	if err := r.SetWithTags("a", "v", 10*time.Second, "user:1"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := m.TTL(setKey); ttl != 10*time.Second {
+		t.Fatalf("new member set ttl = %v, want 10s", ttl)
+	}
+	// a longer lived member extends the set, a shorter one does not
+	if err := r.SetWithTags("b", "v", time.Minute, "user:1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetWithTags("c", "v", time.Second, "user:1"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := m.TTL(setKey); ttl != time.Minute {
+		t.Fatalf("member set ttl = %v, want 1m", ttl)
+	}
+	members, err := r.TagMembers("user:1")
+	if err != nil || len(members) != 3 {
+		t.Fatalf("members = %v, %v", members, err)
+	}
+	m.FastForward(time.Minute)
+	if m.Exists(setKey) {
+		t.Error("member set outlived its members")
+	}
+}
+
+func TestTagMembersWithoutTimeout(t *testing.T) {
+	r, m := newTestRedis(t)
+	setKey := r.tagMembersKey("all")
+	if err := r.SetWithTags("a", "v", 0, "all"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetWithTags("b", "v", time.Second, "all"); err != nil {
+		t.Fatal(err)
+	}
+	m.FastForward(time.Hour)
+	if !m.Exists(setKey) {
+		t.Error("member set of a value without timeout expired")
+	}
+}
+
+func TestInvalidateTags(t *testing.T) {
+	r, _ := newTestRedis(t)
+	if err := r.SetWithTags("a", "v", time.Minute, "t1", "t2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetWithTags("b", "v", time.Minute, "t2"); err != nil {
+		t.Fatal(err)
+	}
+	var v string
+	if err := r.GetTagged("a", &v); err != nil || v != "v" {
+		t.Fatalf("GetTagged = %q, %v", v, err)
+	}
+	if err := r.InvalidateTags("t1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.GetTagged("a", &v); !r.IsKeyNotFound(err) {
+		t.Errorf("invalidated value err = %v, want not found", err)
+	}
+	if err := r.GetTagged("b", &v); err != nil {
+		t.Errorf("value of another tag err = %v", err)
+	}
+}
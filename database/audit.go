@@ -0,0 +1,305 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo/v4"
+	log "github.com/sirupsen/logrus"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+const (
+	auditContextKey = "database:audit_context"
+	auditBeforeKey  = "database:audit_before"
+)
+
+type auditContextKeyType int
+
+const (
+	actorKey auditContextKeyType = iota
+	requestIDKey
+)
+
+// AuditLog is one recorded change. Before and After hold the changed
+// columns only, the whole row for creates and deletes.
+type AuditLog struct {
+	ID        uint64    `gorm:"primary_key" json:"id"`
+	Table     string    `gorm:"column:table_name;size:128;index:idx_audit_logs_record" json:"table"`
+	RecordID  string    `gorm:"size:64;index:idx_audit_logs_record" json:"record_id"`
+	Action    string    `gorm:"size:16" json:"action"`
+	Before    string    `gorm:"type:text" json:"before,omitempty"`
+	After     string    `gorm:"type:text" json:"after,omitempty"`
+	ActorID   string    `gorm:"size:64;index" json:"actor_id,omitempty"`
+	RequestID string    `gorm:"size:64" json:"request_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (AuditLog) TableName() string {
+	return "audit_logs"
+}
+
+func ContextWithActor(ctx context.Context, actorID string) context.Context {
+	return context.WithValue(ctx, actorKey, actorID)
+}
+
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey).(string)
+	return actor
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithContext attaches ctx to the queries of conn, so audit entries get the
+// actor and request id of ctx.
+func WithContext(conn *gorm.DB, ctx context.Context) *gorm.DB {
+	return conn.Set(auditContextKey, ctx)
+}
+
+func (db *Database) WithContext(ctx context.Context) *gorm.DB {
+	return WithContext(db.Ctx, ctx)
+}
+
+type auditor struct {
+	mu     sync.RWMutex
+	models map[reflect.Type]bool
+}
+
+// EnableAudit records every create, update and delete of models, writes by
+// conditions are recorded per affected row. Call it after Connect.
+func (db *Database) EnableAudit(models ...interface{}) error {
+	if err := db.Ctx.AutoMigrate(&AuditLog{}).Error; err != nil {
+		return err
+	}
+	if db.audit == nil {
+		db.audit = &auditor{models: map[reflect.Type]bool{}}
+	}
+	db.audit.mu.Lock()
+	for _, m := range models {
+		db.audit.models[indirectType(reflect.TypeOf(m))] = true
+	}
+	db.audit.mu.Unlock()
+	callback := db.Ctx.Callback()
+	if callback.Create().Get("database:audit_create") != nil {
+		return nil
+	}
+	a := db.audit
+	callback.Create().After("gorm:create").Register("database:audit_create", a.afterCreate)
+	callback.Update().Before("gorm:update").Register("database:audit_before_update", a.snapshotBefore)
+	callback.Update().After("gorm:update").Register("database:audit_update", a.afterUpdate)
+	callback.Delete().Before("gorm:delete").Register("database:audit_before_delete", a.snapshotBefore)
+	callback.Delete().After("gorm:delete").Register("database:audit_delete", a.afterDelete)
+	return nil
+}
+
+// AuditHistory returns the changes of the row of model with primary key id,
+// oldest first.
+func (db *Database) AuditHistory(model interface{}, id interface{}) ([]AuditLog, error) {
+	var logs []AuditLog
+	err := db.Read().
+		Where("table_name = ? AND record_id = ?", db.Ctx.NewScope(model).TableName(), fmt.Sprint(id)).
+		Order("created_at, id").
+		Find(&logs).Error
+	return logs, err
+}
+
+// AuditEchoMiddleware puts the actor returned by actor and the request id
+// into the request context.
+func AuditEchoMiddleware(actor func(c echo.Context) string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			id := req.Header.Get(echo.HeaderXRequestID)
+			if id == "" {
+				id = c.Response().Header().Get(echo.HeaderXRequestID)
+			}
+			ctx := ContextWithRequestID(ContextWithActor(req.Context(), actor(c)), id)
+			c.SetRequest(req.WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+func AuditGinMiddleware(actor func(c *gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(echo.HeaderXRequestID)
+		if id == "" {
+			id = c.Writer.Header().Get(echo.HeaderXRequestID)
+		}
+		ctx := ContextWithRequestID(ContextWithActor(c.Request.Context(), actor(c)), id)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+type auditRow struct {
+	id     interface{}
+	values map[string]interface{}
+}
+
+func (a *auditor) audited(scope *gorm.Scope) bool {
+	if scope.HasError() {
+		return false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.models[scope.GetModelStruct().ModelType]
+}
+
+func (a *auditor) afterCreate(scope *gorm.Scope) {
+	if a.audited(scope) && scope.IndirectValue().Kind() == reflect.Struct {
+		a.write(scope, scope.PrimaryKeyValue(), AuditCreate, nil, columns(scope))
+	}
+}
+
+func (a *auditor) snapshotBefore(scope *gorm.Scope) {
+	if !a.audited(scope) {
+		return
+	}
+	if before, ok := a.load(scope, nil); ok {
+		scope.InstanceSet(auditBeforeKey, before)
+	}
+}
+
+func (a *auditor) afterUpdate(scope *gorm.Scope) {
+	v, ok := scope.InstanceGet(auditBeforeKey)
+	if !ok || scope.HasError() {
+		return
+	}
+	before := v.([]auditRow)
+	if len(before) == 0 {
+		return
+	}
+	ids := make([]interface{}, len(before))
+	for i, row := range before {
+		ids[i] = row.id
+	}
+	rows, ok := a.load(scope, ids)
+	if !ok {
+		return
+	}
+	after := map[string]map[string]interface{}{}
+	for _, row := range rows {
+		after[fmt.Sprint(row.id)] = row.values
+	}
+	for _, row := range before {
+		changedBefore, changedAfter := map[string]interface{}{}, map[string]interface{}{}
+		for k, value := range after[fmt.Sprint(row.id)] {
+			if !reflect.DeepEqual(row.values[k], value) {
+				changedBefore[k], changedAfter[k] = row.values[k], value
+			}
+		}
+		if len(changedAfter) > 0 {
+			a.write(scope, row.id, AuditUpdate, changedBefore, changedAfter)
+		}
+	}
+}
+
+func (a *auditor) afterDelete(scope *gorm.Scope) {
+	v, ok := scope.InstanceGet(auditBeforeKey)
+	if !ok || scope.HasError() {
+		return
+	}
+	for _, row := range v.([]auditRow) {
+		a.write(scope, row.id, AuditDelete, row.values, nil)
+	}
+}
+
+// load reads the stored rows, since the values in scope may be partial. They
+// are the rows with the primary keys ids, the row of the primary key in scope
+// or else the rows matching the conditions of the write itself.
+func (a *auditor) load(scope *gorm.Scope, ids []interface{}) ([]auditRow, bool) {
+	pk := scope.Quote(scope.PrimaryKey())
+	var query *gorm.DB
+	switch {
+	case ids != nil:
+		// including soft deleted ones
+		query = scope.NewDB().Unscoped().Where(pk+" IN (?)", ids)
+	case scope.IndirectValue().Kind() == reflect.Struct && !scope.PrimaryKeyZero():
+		query = scope.NewDB().Unscoped().Where(pk+" = ?", scope.PrimaryKeyValue())
+	default:
+		query = scope.DB().Select("*")
+	}
+	items := reflect.New(reflect.SliceOf(scope.GetModelStruct().ModelType))
+	if err := query.Find(items.Interface()).Error; err != nil {
+		log.Errorln("Audit load error -:", err)
+		scope.Err(err)
+		return nil, false
+	}
+	rows := make([]auditRow, items.Elem().Len())
+	for i := range rows {
+		rowScope := scope.New(items.Elem().Index(i).Addr().Interface())
+		rows[i] = auditRow{id: rowScope.PrimaryKeyValue(), values: columns(rowScope)}
+	}
+	return rows, true
+}
+
+func (a *auditor) write(scope *gorm.Scope, id interface{}, action string, before map[string]interface{}, after map[string]interface{}) {
+	entry := AuditLog{
+		Table:    scope.TableName(),
+		RecordID: fmt.Sprint(id),
+		Action:   action,
+	}
+	if v, ok := scope.Get(auditContextKey); ok {
+		ctx := v.(context.Context)
+		entry.ActorID = ActorFromContext(ctx)
+		entry.RequestID = RequestIDFromContext(ctx)
+	}
+	if before != nil {
+		b, _ := json.Marshal(redact(before))
+		entry.Before = string(b)
+	}
+	if after != nil {
+		b, _ := json.Marshal(redact(after))
+		entry.After = string(b)
+	}
+	// same connection, so the entry commits or rolls back with the change
+	if err := scope.NewDB().Create(&entry).Error; err != nil {
+		scope.Err(err)
+	}
+}
+
+func columns(scope *gorm.Scope) map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, f := range scope.Fields() {
+		if f.IsIgnored || f.Relationship != nil || !f.IsNormal {
+			continue
+		}
+		values[f.DBName] = f.Field.Interface()
+	}
+	return values
+}
+
+// redact keeps the plaintext of encrypted fields out of the audit log.
+func redact(values map[string]interface{}) map[string]interface{} {
+	for k, v := range values {
+		if s, ok := v.(EncryptedString); ok && s != "" {
+			values[k] = "[encrypted]"
+		}
+	}
+	return values
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	return t
+}
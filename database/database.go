@@ -1,25 +1,57 @@
 package database
 
 import (
-	"fmt"
-	"github.com/carlescere/scheduler"
+	"context"
+	"crypto/tls"
+	"database/sql"
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/mysql"
-	log "github.com/sirupsen/logrus"
+	"time"
 )
 
 type Config struct {
+	// Driver is one of MySQL, PostgreSQL, SQLite or MSSQL, default is MySQL.
+	Driver   string
 	Host     string
 	Port     string
 	Username string
 	Password string
-	Name     string
+	// Name is the database name, or the file path for SQLite.
+	Name string
+	// Options are driver specific DSN parameters, for example sslmode and
+	// search_path for PostgreSQL.
+	Options map[string]string
+	// Charset and Collation of MySQL connections, default collation is
+	// utf8mb4_unicode_ci. Collation wins when both are set.
+	Charset   string
+	Collation string
+	// Location is the time zone used to parse and send time values.
+	Location *time.Location
+	// TLS enables encrypted connections. PostgreSQL only derives sslmode from
+	// it, certificates go through Options.
+	TLS            *tls.Config
+	ConnectTimeout time.Duration
+	// ReadTimeout and WriteTimeout are supported by MySQL only.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// Pool settings, zero keeps the database/sql defaults.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	Health          HealthConfig
 }
 
 type Database struct {
 	Config Config
 	Ctx    *gorm.DB
-	Job    *scheduler.Job
+	// Replicas serve the queries made through Read, fields left empty are
+	// taken from Config.
+	Replicas      []Config
+	ReplicaPolicy ReplicaPolicy
+	health        *healthMonitor
+	replicas      []*replica
+	next          uint32
+	audit         *auditor
 }
 
 func New(
@@ -40,59 +72,110 @@ func New(
 	}
 }
 
+func NewWithConfig(config Config) Database {
+	return Database{Config: config}
+}
+
 func (db *Database) Connect(prod bool) error {
-	addr := fmt.Sprintf(
-		"%s:%s@tcp(%s:%s)/%s?charset=utf8&parseTime=true",
-		db.Config.Username,
-		db.Config.Password,
-		db.Config.Host,
-		db.Config.Port,
-		db.Config.Name,
-	)
-	var err error
-	db.Ctx, err = gorm.Open("mysql", addr)
+	conn, err := open(db.Config, prod)
 	if err != nil {
 		return err
 	}
-	if err := db.startKeepAlive(); err != nil {
-		return err
+	var replicas []*replica
+	for _, c := range db.Replicas {
+		rep, err := openReplica(c.inherit(db.Config), prod)
+		if err != nil {
+			_ = conn.Close()
+			closeReplicas(replicas)
+			return err
+		}
+		replicas = append(replicas, rep)
+	}
+	// connecting again replaces the previous connections and monitors
+	if db.Ctx != nil {
+		_ = db.Close()
 	}
-	db.Ctx.LogMode(!prod)
+	db.Ctx = conn
+	db.replicas = replicas
+	db.health = startHealthCheck(conn, db.Config.Health)
 	return nil
 }
 
 func (db *Database) Close() error {
-	_ = db.stopKeepAlive()
+	if db.health != nil {
+		db.health.stop()
+	}
+	closeReplicas(db.replicas)
+	db.replicas = nil
 	if err := db.Ctx.Close(); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (db *Database) MigrateDatabase(tables []interface{}) error {
-	tx := db.Ctx.Begin()
-	for _, t := range tables {
-		if err := tx.AutoMigrate(t).Error; err != nil {
-			_ = tx.Rollback()
-			return err
-		}
+// Healthy reports whether the last health check succeeded, for readiness
+// probes.
+func (db *Database) Healthy() bool {
+	return db.health != nil && db.health.get().Healthy
+}
+
+func (db *Database) HealthStatus() HealthStatus {
+	if db.health == nil {
+		return HealthStatus{}
 	}
-	return tx.Commit().Error
+	return db.health.get()
 }
 
-func (db *Database) startKeepAlive() error {
-	var err error
-	db.Job, err = scheduler.Every(15).Seconds().Run(func() {
-		if err := db.Ctx.DB().Ping(); err != nil {
-			log.Errorln("Database keepalive error -:", err)
-		}
-	})
-	return err
+// Stats returns the connection pool statistics.
+func (db *Database) Stats() sql.DBStats {
+	return db.Ctx.DB().Stats()
+}
+
+func open(c Config, prod bool) (*gorm.DB, error) {
+	addr, err := c.DSN()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := gorm.Open(c.driver(), addr)
+	if err != nil {
+		return nil, err
+	}
+	configurePool(conn.DB(), c)
+	conn.LogMode(!prod)
+	return conn, nil
+}
+
+func configurePool(pool *sql.DB, c Config) {
+	if c.MaxOpenConns > 0 {
+		pool.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns > 0 {
+		pool.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	if c.ConnMaxLifetime > 0 {
+		pool.SetConnMaxLifetime(c.ConnMaxLifetime)
+	}
+	if c.ConnMaxIdleTime > 0 {
+		pool.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+	}
 }
 
-func (db *Database) stopKeepAlive() error {
-	if db.Job != nil {
-		db.Job.Quit <- true
+// MigrateDatabase runs gorm AutoMigrate on tables, it only creates tables,
+// columns and indexes. Use a Migrator for any other schema change.
+func (db *Database) MigrateDatabase(tables []interface{}) error {
+	for _, t := range tables {
+		if err := db.Ctx.AutoMigrate(t).Error; err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+func startHealthCheck(conn *gorm.DB, config HealthConfig) *healthMonitor {
+	pool := conn.DB()
+	m := newHealthMonitor(func(ctx context.Context) error {
+		return pool.PingContext(ctx)
+	}, config)
+	m.start()
+	return m
+}
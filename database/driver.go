@@ -0,0 +1,190 @@
+package database
+
+import (
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/jinzhu/gorm/dialects/mssql"
+	_ "github.com/jinzhu/gorm/dialects/mysql"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	uuid "github.com/satori/go.uuid"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MySQL      = "mysql"
+	PostgreSQL = "postgres"
+	SQLite     = "sqlite3"
+	MSSQL      = "mssql"
+)
+
+const DefaultCollation = "utf8mb4_unicode_ci"
+
+// SQLiteMemory as Config.Name opens an in-memory SQLite database shared by
+// all connections of the pool and private to it.
+const SQLiteMemory = ":memory:"
+
+var defaultPorts = map[string]string{
+	MySQL:      "3306",
+	PostgreSQL: "5432",
+	MSSQL:      "1433",
+}
+
+// DSN returns the data source name of the config for its driver.
+func (c Config) DSN() (string, error) {
+	switch c.driver() {
+	case MySQL:
+		return c.mysqlDSN()
+	case PostgreSQL:
+		return c.postgresDSN(), nil
+	case SQLite:
+		return c.sqliteDSN(), nil
+	case MSSQL:
+		return c.mssqlDSN(), nil
+	}
+	return "", fmt.Errorf("unsupported database driver %s", c.Driver)
+}
+
+func (c Config) driver() string {
+	if c.Driver == "" {
+		return MySQL
+	}
+	return strings.ToLower(c.Driver)
+}
+
+func (c Config) addr() string {
+	port := c.Port
+	if port == "" {
+		port = defaultPorts[c.driver()]
+	}
+	return net.JoinHostPort(c.Host, port)
+}
+
+func (c Config) mysqlDSN() (string, error) {
+	cfg := mysql.NewConfig()
+	cfg.User = c.Username
+	cfg.Passwd = c.Password
+	cfg.Net = "tcp"
+	cfg.Addr = c.addr()
+	cfg.DBName = c.Name
+	cfg.ParseTime = true
+	cfg.Params = map[string]string{}
+	switch {
+	case c.Collation != "":
+		// the handshake collation also sets the charset, while a charset
+		// param would reset it to the charset's default collation
+		cfg.Collation = c.Collation
+	case c.Charset != "":
+		cfg.Params["charset"] = c.Charset
+	default:
+		cfg.Collation = DefaultCollation
+	}
+	if c.Location != nil {
+		cfg.Loc = c.Location
+	}
+	if c.TLS != nil {
+		name := fmt.Sprintf("go_swth_%s_%s", cfg.Addr, c.Name)
+		if err := mysql.RegisterTLSConfig(name, c.TLS); err != nil {
+			return "", err
+		}
+		cfg.TLSConfig = name
+	}
+	cfg.Timeout = c.ConnectTimeout
+	cfg.ReadTimeout = c.ReadTimeout
+	cfg.WriteTimeout = c.WriteTimeout
+	for k, v := range c.Options {
+		cfg.Params[k] = v
+	}
+	return cfg.FormatDSN(), nil
+}
+
+// postgresDSN passes options such as sslmode or search_path as parameters.
+func (c Config) postgresDSN() string {
+	q := c.query()
+	if c.TLS != nil {
+		mode := "verify-full"
+		if c.TLS.InsecureSkipVerify {
+			mode = "require"
+		}
+		setDefault(q, "sslmode", mode)
+	}
+	if c.ConnectTimeout > 0 {
+		setDefault(q, "connect_timeout", seconds(c.ConnectTimeout))
+	}
+	if c.Location != nil {
+		setDefault(q, "timezone", c.Location.String())
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     c.userinfo(),
+		Host:     c.addr(),
+		Path:     "/" + c.Name,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+func (c Config) sqliteDSN() string {
+	q := c.query()
+	name := c.Name
+	if name == "" || name == SQLiteMemory {
+		// a named in-memory database is shared by the connections of one pool
+		// only, every open gets a database of its own
+		name = "memdb-" + uuid.NewV4().String()
+		q.Set("mode", "memory")
+		q.Set("cache", "shared")
+	}
+	if c.Location != nil {
+		setDefault(q, "_loc", c.Location.String())
+	}
+	return fmt.Sprintf("file:%s?%s", name, q.Encode())
+}
+
+func (c Config) mssqlDSN() string {
+	q := c.query()
+	q.Set("database", c.Name)
+	if c.TLS != nil {
+		setDefault(q, "encrypt", "true")
+		setDefault(q, "TrustServerCertificate", strconv.FormatBool(c.TLS.InsecureSkipVerify))
+	}
+	if c.ConnectTimeout > 0 {
+		setDefault(q, "dial timeout", seconds(c.ConnectTimeout))
+	}
+	u := url.URL{
+		Scheme:   "sqlserver",
+		User:     c.userinfo(),
+		Host:     c.addr(),
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+func (c Config) userinfo() *url.Userinfo {
+	if c.Username == "" {
+		return nil
+	}
+	return url.UserPassword(c.Username, c.Password)
+}
+
+func (c Config) query() url.Values {
+	q := url.Values{}
+	for k, v := range c.Options {
+		q.Set(k, v)
+	}
+	return q
+}
+
+func setDefault(q url.Values, key string, value string) {
+	if _, ok := q[key]; !ok {
+		q.Set(key, value)
+	}
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
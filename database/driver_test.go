@@ -0,0 +1,19 @@
+package database
+
+import (
+	"testing"
+)
+
+func TestSQLiteMemoryIsPrivate(t *testing.T) {
+	type memoryItem struct{ ID uint64 }
+	a, b := openTestDB(t), openTestDB(t)
+	if err := a.AutoMigrate(&memoryItem{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !a.HasTable(&memoryItem{}) {
+		t.Fatal("table missing on the connection that created it")
+	}
+	if b.HasTable(&memoryItem{}) {
+		t.Error("in-memory databases are shared between opens")
+	}
+}
@@ -0,0 +1,294 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var ErrNoKeyring = errors.New("encryption keyring is not set")
+
+const (
+	encryptedPrefix    = "enc:v1"
+	minBlindIndexKey   = 32
+	blindIndexCallback = "database:blind_index"
+)
+
+// Keyring holds the AES keys of encrypted fields by id. New values are
+// encrypted with the current key, older keys stay usable for reading until
+// every row has been re-encrypted.
+type Keyring struct {
+	current  string
+	keys     map[string]cipher.AEAD
+	indexKey []byte
+}
+
+var (
+	keyringMu sync.RWMutex
+	keyring   *Keyring
+)
+
+// NewKeyring takes AES-128, 192 or 256 keys by id, current names the key
+// used for encryption and indexKey, at least 32 bytes, is the HMAC key of
+// blind indexes.
+func NewKeyring(current string, keys map[string][]byte, indexKey []byte) (*Keyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current key %s is not in the keyring", current)
+	}
+	if len(indexKey) < minBlindIndexKey {
+		// a short key lets anyone recompute the indexes of guessable values
+		return nil, fmt.Errorf("blind index key must be at least %d bytes", minBlindIndexKey)
+	}
+	k := &Keyring{current: current, keys: map[string]cipher.AEAD{}, indexKey: indexKey}
+	for id, key := range keys {
+		if strings.Contains(id, ":") {
+			return nil, fmt.Errorf("key id %s must not contain a colon", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if k.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// SetKeyring sets the keyring used by EncryptedString and blind indexes.
+func SetKeyring(k *Keyring) {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	keyring = k
+}
+
+func currentKeyring() (*Keyring, error) {
+	keyringMu.RLock()
+	defer keyringMu.RUnlock()
+	if keyring == nil {
+		return nil, ErrNoKeyring
+	}
+	return keyring, nil
+}
+
+// Encrypt returns enc:v1:<key id>:<base64 nonce and ciphertext>.
+func (k *Keyring) Encrypt(plaintext []byte) (string, error) {
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(k.current))
+	return fmt.Sprintf("%s:%s:%s", encryptedPrefix, k.current, base64.RawStdEncoding.EncodeToString(sealed)), nil
+}
+
+func (k *Keyring) Decrypt(s string) ([]byte, error) {
+	parts := strings.SplitN(s, ":", 4)
+	if len(parts) != 4 || parts[0]+":"+parts[1] != encryptedPrefix {
+		return nil, fmt.Errorf("value is not encrypted")
+	}
+	aead, ok := k.keys[parts[2]]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %s", parts[2])
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted value is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(parts[2]))
+}
+
+// NeedsRotation reports whether s was encrypted with another key than the
+// current one.
+func (k *Keyring) NeedsRotation(s string) bool {
+	parts := strings.SplitN(s, ":", 4)
+	return len(parts) == 4 && parts[2] != k.current
+}
+
+// BlindIndex returns the value to store in, or search a blind index column
+// for, the plaintext v.
+func (k *Keyring) BlindIndex(v string) string {
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(v))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// BlindIndex uses the keyring set by SetKeyring.
+func BlindIndex(v string) (string, error) {
+	k, err := currentKeyring()
+	if err != nil {
+		return "", err
+	}
+	return k.BlindIndex(v), nil
+}
+
+// EncryptedString is stored encrypted with AES-GCM and read back as
+// plaintext. The column needs room for the ciphertext, for example
+// gorm:"type:text". Empty strings are stored as is.
+type EncryptedString string
+
+func (s EncryptedString) Value() (driver.Value, error) {
+	if s == "" {
+		return "", nil
+	}
+	k, err := currentKeyring()
+	if err != nil {
+		return nil, err
+	}
+	return k.Encrypt([]byte(s))
+}
+
+func (s *EncryptedString) Scan(src interface{}) error {
+	var stored string
+	switch v := src.(type) {
+	case nil:
+	case string:
+		stored = v
+	case []byte:
+		stored = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into EncryptedString", src)
+	}
+	if stored == "" {
+		*s = ""
+		return nil
+	}
+	k, err := currentKeyring()
+	if err != nil {
+		return err
+	}
+	plaintext, err := k.Decrypt(stored)
+	if err != nil {
+		return err
+	}
+	*s = EncryptedString(plaintext)
+	return nil
+}
+
+// EnableEncryption sets k as the keyring and fills the blind index columns
+// of models on create and update. They are tagged with the field they index,
+// for example PhoneIndex string `blind:"Phone"`. Call it after Connect.
+func (db *Database) EnableEncryption(k *Keyring) error {
+	if k == nil {
+		return ErrNoKeyring
+	}
+	SetKeyring(k)
+	callback := db.Ctx.Callback()
+	if callback.Create().Get(blindIndexCallback) != nil {
+		return nil
+	}
+	callback.Create().Before("gorm:create").Register(blindIndexCallback, fillBlindIndexes)
+	callback.Update().After("gorm:assign_updating_attributes").Before("gorm:update").Register(blindIndexCallback, fillBlindIndexes)
+	return nil
+}
+
+func fillBlindIndexes(scope *gorm.Scope) {
+	if scope.HasError() || scope.IndirectValue().Kind() != reflect.Struct {
+		return
+	}
+	attrs, _ := scope.InstanceGet("gorm:update_attrs")
+	updates, _ := attrs.(map[string]interface{})
+	for _, f := range scope.Fields() {
+		source := f.Tag.Get("blind")
+		if source == "" {
+			continue
+		}
+		sourceField, ok := scope.FieldByName(source)
+		if !ok {
+			scope.Err(fmt.Errorf("blind index source %s not found", source))
+			return
+		}
+		if updates != nil {
+			// Updates only writes the given columns
+			if _, ok := updates[sourceField.DBName]; !ok {
+				continue
+			}
+		}
+		value := reflect.Indirect(sourceField.Field)
+		if value.Kind() != reflect.String {
+			scope.Err(fmt.Errorf("blind index source %s is not a string", source))
+			return
+		}
+		index := ""
+		if value.String() != "" {
+			var err error
+			if index, err = BlindIndex(value.String()); err != nil {
+				scope.Err(err)
+				return
+			}
+		}
+		if updates != nil {
+			updates[f.DBName] = index
+		} else if err := f.Set(index); err != nil {
+			scope.Err(err)
+			return
+		}
+	}
+}
+
+// Reencrypt writes the EncryptedString columns of every row of model again in
+// batches by primary key, so they move to the current key after a rotation.
+// Only those columns are written, UpdatedAt and the other columns are kept.
+func Reencrypt(conn *gorm.DB, model interface{}, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	t := indirectType(reflect.TypeOf(model))
+	scope := conn.NewScope(reflect.New(t).Interface())
+	encrypted := map[string]bool{}
+	for _, f := range scope.Fields() {
+		if indirectType(f.Struct.Type) == reflect.TypeOf(EncryptedString("")) {
+			encrypted[f.DBName] = true
+		}
+	}
+	if len(encrypted) == 0 {
+		return 0, fmt.Errorf("%s has no encrypted fields", t)
+	}
+	pk := scope.Quote(scope.PrimaryKey())
+	var last interface{}
+	count := 0
+	for {
+		rows := reflect.New(reflect.SliceOf(t))
+		query := conn.Order(pk).Limit(batchSize)
+		if last != nil {
+			query = query.Where(pk+" > ?", last)
+		}
+		if err := query.Find(rows.Interface()).Error; err != nil {
+			return count, err
+		}
+		items := rows.Elem()
+		for i := 0; i < items.Len(); i++ {
+			row := items.Index(i).Addr().Interface()
+			rowScope := conn.NewScope(row)
+			values := map[string]interface{}{}
+			for _, f := range rowScope.Fields() {
+				if encrypted[f.DBName] {
+					values[f.DBName] = f.Field.Interface()
+				}
+			}
+			if err := conn.Model(row).UpdateColumns(values).Error; err != nil {
+				return count, err
+			}
+			last = rowScope.PrimaryKeyValue()
+			count++
+		}
+		if items.Len() < batchSize {
+			return count, nil
+		}
+	}
+}
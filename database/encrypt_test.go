@@ -0,0 +1,203 @@
+package database
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testKey1     = bytes.Repeat([]byte{1}, 32)
+	testKey2     = bytes.Repeat([]byte{2}, 32)
+	testIndexKey = bytes.Repeat([]byte{3}, 32)
+)
+
+func newTestKeyring(t *testing.T, current string, keys map[string][]byte) *Keyring {
+	k, err := NewKeyring(current, keys, testIndexKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKeyringEncryptDecrypt(t *testing.T) {
+	k := newTestKeyring(t, "k1", map[string][]byte{"k1": testKey1})
+	a, err := k.Encrypt([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := k.Encrypt([]byte("secret"))
+	if a == b || !strings.HasPrefix(a, "enc:v1:k1:") {
+		t.Fatalf("ciphertexts %q and %q", a, b)
+	}
+	if got, err := k.Decrypt(a); err != nil || string(got) != "secret" {
+		t.Fatalf("Decrypt = %q, %v", got, err)
+	}
+	invalid := map[string]string{
+		"plaintext":   "secret",
+		"unknown key": strings.Replace(a, ":k1:", ":k9:", 1),
+		"tampered":    a[:len(a)-2] + "AA",
+		"too short":   "enc:v1:k1:AAAA",
+		"not base64":  "enc:v1:k1:!!",
+	}
+	for name, s := range invalid {
+		if _, err := k.Decrypt(s); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	old := newTestKeyring(t, "k1", map[string][]byte{"k1": testKey1})
+	s, err := old.Encrypt([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := newTestKeyring(t, "k2", map[string][]byte{"k1": testKey1, "k2": testKey2})
+	if got, err := k.Decrypt(s); err != nil || string(got) != "secret" {
+		t.Fatalf("Decrypt with the old key = %q, %v", got, err)
+	}
+	if !k.NeedsRotation(s) {
+		t.Error("value of the old key does not need rotation")
+	}
+	current, _ := k.Encrypt([]byte("secret"))
+	if k.NeedsRotation(current) {
+		t.Error("value of the current key needs rotation")
+	}
+	if _, err := newTestKeyring(t, "k2", map[string][]byte{"k2": testKey2}).Decrypt(s); err == nil {
+		t.Error("expected an error after the old key was removed")
+	}
+}
+
+func TestNewKeyringErrors(t *testing.T) {
+	tests := map[string]func() (*Keyring, error){
+		"unknown current": func() (*Keyring, error) { return NewKeyring("k2", map[string][]byte{"k1": testKey1}, testIndexKey) },
+		"short index key": func() (*Keyring, error) { return NewKeyring("k1", map[string][]byte{"k1": testKey1}, []byte("short")) },
+		"colon in id":     func() (*Keyring, error) { return NewKeyring("a:b", map[string][]byte{"a:b": testKey1}, testIndexKey) },
+		"bad key size": func() (*Keyring, error) {
+			return NewKeyring("k1", map[string][]byte{"k1": []byte("short")}, testIndexKey)
+		},
+	}
+	for name, fn := range tests {
+		if _, err := fn(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestBlindIndex(t *testing.T) {
+	k := newTestKeyring(t, "k1", map[string][]byte{"k1": testKey1})
+	if k.BlindIndex("0812345678") != k.BlindIndex("0812345678") {
+		t.Error("blind index is not deterministic")
+	}
+	if k.BlindIndex("a") == k.BlindIndex("b") {
+		t.Error("different values share a blind index")
+	}
+	other, _ := NewKeyring("k1", map[string][]byte{"k1": testKey1}, bytes.Repeat([]byte{4}, 32))
+	if other.BlindIndex("a") == k.BlindIndex("a") {
+		t.Error("blind index does not depend on the index key")
+	}
+}
+
+type encryptedItem struct {
+	ID         uint64
+	Phone      EncryptedString `gorm:"type:text"`
+	PhoneIndex string          `blind:"Phone"`
+	Note       string
+	UpdatedAt  time.Time
+}
+
+func openEncryptedDB(t *testing.T, k *Keyring) *Database {
+	db := &Database{Ctx: openTestDB(t)}
+	if err := db.EnableEncryption(k); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetKeyring(nil) })
+	if err := db.Ctx.AutoMigrate(&encryptedItem{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func storedPhone(t *testing.T, db *Database, id uint64) string {
+	var s string
+	if err := db.Ctx.Table("encrypted_items").Where("id = ?", id).Select("phone").Row().Scan(&s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestFillBlindIndexes(t *testing.T) {
+	k := newTestKeyring(t, "k1", map[string][]byte{"k1": testKey1})
+	db := openEncryptedDB(t, k)
+	item := encryptedItem{Phone: "0811111111"}
+	if err := db.Ctx.Create(&item).Error; err != nil {
+		t.Fatal(err)
+	}
+	if item.PhoneIndex != k.BlindIndex("0811111111") {
+		t.Errorf("index on create = %q", item.PhoneIndex)
+	}
+	if stored := storedPhone(t, db, item.ID); !strings.HasPrefix(stored, encryptedPrefix) {
+		t.Errorf("phone stored as %q", stored)
+	}
+	var found encryptedItem
+	if err := db.Ctx.Where("phone_index = ?", k.BlindIndex("0811111111")).First(&found).Error; err != nil || found.Phone != "0811111111" {
+		t.Fatalf("lookup by blind index = %+v, %v", found, err)
+	}
+
+	if err := db.Ctx.Model(&item).Updates(map[string]interface{}{"phone": EncryptedString("0822222222")}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ctx.First(&found, item.ID).Error; err != nil || found.PhoneIndex != k.BlindIndex("0822222222") {
+		t.Errorf("index after Updates = %q, %v", found.PhoneIndex, err)
+	}
+	// an update without the source column keeps the index
+	if err := db.Ctx.Model(&item).Updates(map[string]interface{}{"note": "x"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ctx.First(&found, item.ID).Error; err != nil || found.PhoneIndex != k.BlindIndex("0822222222") {
+		t.Errorf("index after unrelated Updates = %q, %v", found.PhoneIndex, err)
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	db := openEncryptedDB(t, newTestKeyring(t, "k1", map[string][]byte{"k1": testKey1}))
+	updatedAt := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	for _, phone := range []EncryptedString{"0811111111", "", "0833333333"} {
+		item := encryptedItem{Phone: phone, Note: "n"}
+		if err := db.Ctx.Create(&item).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Ctx.Model(&item).UpdateColumn("updated_at", updatedAt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	k := newTestKeyring(t, "k2", map[string][]byte{"k1": testKey1, "k2": testKey2})
+	if err := db.EnableEncryption(k); err != nil {
+		t.Fatal(err)
+	}
+	n, err := Reencrypt(db.Ctx, &encryptedItem{}, 2)
+	if err != nil || n != 3 {
+		t.Fatalf("Reencrypt = %d, %v", n, err)
+	}
+	var items []encryptedItem
+	if err := db.Ctx.Order("id").Find(&items).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i, item := range items {
+		stored := storedPhone(t, db, item.ID)
+		if stored != "" && k.NeedsRotation(stored) {
+			t.Errorf("row %d still uses the old key", i)
+		}
+		if !item.UpdatedAt.Equal(updatedAt) || item.Note != "n" {
+			t.Errorf("row %d changed: %+v", i, item)
+		}
+	}
+	if items[0].Phone != "0811111111" || items[1].Phone != "" || items[2].Phone != "0833333333" {
+		t.Errorf("phones = %q %q %q", items[0].Phone, items[1].Phone, items[2].Phone)
+	}
+	if _, err := Reencrypt(db.Ctx, &keysetItem{}, 0); err == nil {
+		t.Error("expected an error for a model without encrypted fields")
+	}
+}
@@ -0,0 +1,150 @@
+package database
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHealthInterval   = 15 * time.Second
+	DefaultHealthTimeout    = 5 * time.Second
+	DefaultHealthMinBackoff = time.Second
+	DefaultHealthMaxBackoff = 30 * time.Second
+)
+
+type HealthConfig struct {
+	// Interval between checks while the database is healthy.
+	Interval time.Duration
+	// Timeout of a single ping.
+	Timeout time.Duration
+	// MinBackoff and MaxBackoff bound the delay between reconnect attempts
+	// while the database is down, doubling after every failure.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// OnStateChange is called when the database goes down or comes back.
+	OnStateChange func(status HealthStatus)
+}
+
+type HealthStatus struct {
+	Healthy   bool          `json:"healthy"`
+	LastError error         `json:"-"`
+	Latency   time.Duration `json:"latency"`
+	CheckedAt time.Time     `json:"checked_at"`
+	// Failures counts the consecutive failed checks.
+	Failures int `json:"failures"`
+}
+
+// healthMonitor pings in the background. database/sql drops broken
+// connections and dials new ones on the next ping, so retrying the ping with
+// backoff is what reconnects the pool.
+type healthMonitor struct {
+	ping   func(ctx context.Context) error
+	config HealthConfig
+	mu     sync.RWMutex
+	status HealthStatus
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newHealthMonitor(ping func(ctx context.Context) error, config HealthConfig) *healthMonitor {
+	if config.Interval <= 0 {
+		config.Interval = DefaultHealthInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultHealthTimeout
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = DefaultHealthMinBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = DefaultHealthMaxBackoff
+		if config.MaxBackoff < config.MinBackoff {
+			config.MaxBackoff = config.MinBackoff
+		}
+	}
+	return &healthMonitor{
+		ping:   ping,
+		config: config,
+		status: HealthStatus{Healthy: true, CheckedAt: time.Now()},
+	}
+}
+
+func (m *healthMonitor) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.done = make(chan struct{})
+	go m.run(ctx)
+}
+
+func (m *healthMonitor) stop() {
+	if m.cancel == nil {
+		return
+	}
+	m.cancel()
+	<-m.done
+	m.cancel = nil
+}
+
+func (m *healthMonitor) run(ctx context.Context) {
+	defer close(m.done)
+	backoff := m.config.MinBackoff
+	for {
+		wait := m.config.Interval
+		if !m.check(ctx) {
+			wait = backoff
+			if backoff *= 2; backoff > m.config.MaxBackoff {
+				backoff = m.config.MaxBackoff
+			}
+		} else {
+			backoff = m.config.MinBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (m *healthMonitor) check(ctx context.Context) bool {
+	pingCtx, cancel := context.WithTimeout(ctx, m.config.Timeout)
+	defer cancel()
+	start := time.Now()
+	err := m.ping(pingCtx)
+	if ctx.Err() != nil {
+		return true
+	}
+	m.mu.Lock()
+	changed := m.status.Healthy != (err == nil)
+	m.status.Healthy = err == nil
+	m.status.LastError = err
+	m.status.Latency = time.Since(start)
+	m.status.CheckedAt = time.Now()
+	if err != nil {
+		m.status.Failures++
+	} else {
+		m.status.Failures = 0
+	}
+	status := m.status
+	m.mu.Unlock()
+	if err != nil {
+		log.Errorln("Database health check error -:", err)
+	}
+	if changed {
+		if status.Healthy {
+			log.Infoln("Database connection restored")
+		}
+		if m.config.OnStateChange != nil {
+			m.config.OnStateChange(status)
+		}
+	}
+	return status.Healthy
+}
+
+func (m *healthMonitor) get() HealthStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
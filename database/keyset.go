@@ -0,0 +1,241 @@
+package database
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/patcharp/go_swth/server"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCursor  = errors.New("invalid cursor")
+	ErrNoCursorSecret = errors.New("keyset cursor secret is not set")
+)
+
+type KeysetColumn struct {
+	Name string
+	Desc bool
+}
+
+// Keyset paginates over ordered columns by remembering the last row seen
+// instead of an offset. The primary key is appended as the last column so
+// rows with equal values keep a stable order.
+type Keyset struct {
+	Columns []KeysetColumn
+	// PrimaryKey defaults to the primary key of the model.
+	PrimaryKey string
+	// Secret signs the cursors so clients can not forge them, it is
+	// required.
+	Secret []byte
+}
+
+type CursorPage struct {
+	Items      interface{} `json:"items"`
+	Limit      uint        `json:"limit"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	PrevCursor string      `json:"prev_cursor,omitempty"`
+	HasNext    bool        `json:"has_next"`
+	HasPrev    bool        `json:"has_prev"`
+}
+
+type cursor struct {
+	Backward bool          `json:"b,omitempty"`
+	Values   []interface{} `json:"v"`
+}
+
+// Paginate loads the page of query after or before p.Cursor into dest, a
+// pointer to a slice. The ordering of query is replaced by the keyset one.
+func (k Keyset) Paginate(query *gorm.DB, p server.CursorPagination, dest interface{}) (CursorPage, error) {
+	if p.Limit == 0 {
+		p.Limit = server.DefaultQuerySize
+	}
+	page := CursorPage{Items: dest, Limit: p.Limit}
+	if len(k.Secret) == 0 {
+		return page, ErrNoCursorSecret
+	}
+	scope := query.NewScope(dest)
+	columns := k.columns(scope)
+	var cur cursor
+	if p.Cursor != "" {
+		var err error
+		if cur, err = k.decode(p.Cursor); err != nil {
+			return page, err
+		}
+		if len(cur.Values) != len(columns) {
+			return page, ErrInvalidCursor
+		}
+		where, args := keysetCondition(scope, columns, cur)
+		query = query.Where(where, args...)
+	}
+	for i, c := range columns {
+		// walking backward reads the rows in reverse and flips them after
+		dir := "ASC"
+		if c.Desc != cur.Backward {
+			dir = "DESC"
+		}
+		query = query.Order(scope.Quote(c.Name)+" "+dir, i == 0)
+	}
+	if err := query.Limit(p.Limit + 1).Find(dest).Error; err != nil {
+		return page, err
+	}
+	items := reflect.ValueOf(dest).Elem()
+	more := uint(items.Len()) > p.Limit
+	if more {
+		items.Set(items.Slice(0, int(p.Limit)))
+	}
+	if cur.Backward {
+		reverse(items)
+		page.HasPrev, page.HasNext = more, true
+	} else {
+		page.HasPrev, page.HasNext = p.Cursor != "", more
+	}
+	if items.Len() == 0 {
+		return page, nil
+	}
+	var err error
+	if page.HasNext {
+		if page.NextCursor, err = k.encode(scope, columns, items.Index(items.Len()-1), false); err != nil {
+			return page, err
+		}
+	}
+	if page.HasPrev {
+		if page.PrevCursor, err = k.encode(scope, columns, items.Index(0), true); err != nil {
+			return page, err
+		}
+	}
+	return page, nil
+}
+
+func (k Keyset) columns(scope *gorm.Scope) []KeysetColumn {
+	pk := k.PrimaryKey
+	if pk == "" {
+		pk = scope.PrimaryKey()
+	}
+	columns := append([]KeysetColumn{}, k.Columns...)
+	for _, c := range columns {
+		if columnName(c.Name) == columnName(pk) {
+			return columns
+		}
+	}
+	desc := false
+	if len(columns) > 0 {
+		desc = columns[len(columns)-1].Desc
+	}
+	return append(columns, KeysetColumn{Name: pk, Desc: desc})
+}
+
+// keysetCondition selects the rows after the cursor in its direction,
+// (a > x) OR (a = x AND b > y) and so on, which also works for columns
+// ordered in different directions.
+func keysetCondition(scope *gorm.Scope, columns []KeysetColumn, cur cursor) (string, []interface{}) {
+	var or []string
+	var args []interface{}
+	for i, c := range columns {
+		var and []string
+		for j := 0; j < i; j++ {
+			and = append(and, scope.Quote(columns[j].Name)+" = ?")
+			args = append(args, cur.Values[j])
+		}
+		op := ">"
+		if c.Desc != cur.Backward {
+			op = "<"
+		}
+		and = append(and, fmt.Sprintf("%s %s ?", scope.Quote(c.Name), op))
+		args = append(args, cur.Values[i])
+		or = append(or, "("+strings.Join(and, " AND ")+")")
+	}
+	return "(" + strings.Join(or, " OR ") + ")", args
+}
+
+func (k Keyset) encode(scope *gorm.Scope, columns []KeysetColumn, item reflect.Value, backward bool) (string, error) {
+	for item.Kind() == reflect.Ptr {
+		item = item.Elem()
+	}
+	itemScope := scope.New(item.Addr().Interface())
+	cur := cursor{Backward: backward}
+	for _, c := range columns {
+		field, ok := itemScope.FieldByName(columnName(c.Name))
+		if !ok {
+			return "", fmt.Errorf("keyset column %s not found in %s", c.Name, item.Type())
+		}
+		v := field.Field.Interface()
+		if t, ok := v.(time.Time); ok {
+			// keep the type, a plain string does not compare as a time
+			v = map[string]string{"t": t.Format(time.RFC3339Nano)}
+		}
+		cur.Values = append(cur.Values, v)
+	}
+	payload, err := json.Marshal(&cur)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(k.sign(payload)), nil
+}
+
+func (k Keyset) decode(s string) (cursor, error) {
+	var cur cursor
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return cur, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return cur, ErrInvalidCursor
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, k.sign(payload)) {
+		return cur, ErrInvalidCursor
+	}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&cur); err != nil {
+		return cur, ErrInvalidCursor
+	}
+	for i, v := range cur.Values {
+		switch value := v.(type) {
+		case json.Number:
+			if n, err := value.Int64(); err == nil {
+				cur.Values[i] = n
+			} else if f, err := value.Float64(); err == nil {
+				cur.Values[i] = f
+			}
+		case map[string]interface{}:
+			s, _ := value["t"].(string)
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return cur, ErrInvalidCursor
+			}
+			cur.Values[i] = t
+		}
+	}
+	return cur, nil
+}
+
+func (k Keyset) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// columnName strips the table from a qualified column name.
+func columnName(name string) string {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+func reverse(items reflect.Value) {
+	swap := reflect.Swapper(items.Interface())
+	for i, j := 0, items.Len()-1; i < j; i, j = i+1, j-1 {
+		swap(i, j)
+	}
+}
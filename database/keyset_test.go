@@ -0,0 +1,185 @@
+package database
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/patcharp/go_swth/server"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type keysetItem struct {
+	ID        uint64
+	Score     int
+	Name      string
+	CreatedAt time.Time
+}
+
+func openTestDB(t *testing.T) *gorm.DB {
+	conn, err := open(Config{Driver: SQLite, Name: SQLiteMemory}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestKeysetCondition(t *testing.T) {
+	scope := openTestDB(t).NewScope(&keysetItem{})
+	columns := []KeysetColumn{{Name: "score", Desc: true}, {Name: "id"}}
+	tests := []struct {
+		name  string
+		cur   cursor
+		where string
+		args  []interface{}
+	}{
+		{
+			name:  "forward",
+			cur:   cursor{Values: []interface{}{10, 5}},
+			where: `(("score" < ?) OR ("score" = ? AND "id" > ?))`,
+			args:  []interface{}{10, 10, 5},
+		},
+		{
+			name:  "backward",
+			cur:   cursor{Backward: true, Values: []interface{}{10, 5}},
+			where: `(("score" > ?) OR ("score" = ? AND "id" < ?))`,
+			args:  []interface{}{10, 10, 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where, args := keysetCondition(scope, columns, tt.cur)
+			if where != tt.where {
+				t.Errorf("where = %s, want %s", where, tt.where)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args = %v, want %v", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestKeysetColumns(t *testing.T) {
+	scope := openTestDB(t).NewScope(&keysetItem{})
+	tests := []struct {
+		name   string
+		keyset Keyset
+		want   []KeysetColumn
+	}{
+		{
+			name:   "appends the primary key",
+			keyset: Keyset{Columns: []KeysetColumn{{Name: "score", Desc: true}}},
+			want:   []KeysetColumn{{Name: "score", Desc: true}, {Name: "id", Desc: true}},
+		},
+		{
+			name:   "primary key already ordered",
+			keyset: Keyset{Columns: []KeysetColumn{{Name: "items.id"}}},
+			want:   []KeysetColumn{{Name: "items.id"}},
+		},
+		{
+			name: "primary key only",
+			want: []KeysetColumn{{Name: "id"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.keyset.columns(scope); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("columns = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeysetCursorRoundTrip(t *testing.T) {
+	scope := openTestDB(t).NewScope(&keysetItem{})
+	k := Keyset{Secret: []byte("secret")}
+	columns := []KeysetColumn{{Name: "created_at"}, {Name: "name"}, {Name: "score"}, {Name: "id"}}
+	created := time.Date(2020, 6, 1, 12, 30, 0, 123456789, time.UTC)
+	item := keysetItem{ID: 42, Score: -3, Name: "a.b", CreatedAt: created}
+	s, err := k.encode(scope, columns, reflect.ValueOf(&item), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := k.decode(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := cursor{Backward: true, Values: []interface{}{created, "a.b", int64(-3), int64(42)}}
+	if !cur.Values[0].(time.Time).Equal(created) {
+		t.Errorf("time = %v, want %v", cur.Values[0], created)
+	}
+	cur.Values[0] = created
+	if !reflect.DeepEqual(cur, want) {
+		t.Errorf("cursor = %#v, want %#v", cur, want)
+	}
+
+	invalid := map[string]string{
+		"other secret": func() string {
+			s, _ := Keyset{Secret: []byte("other")}.encode(scope, columns, reflect.ValueOf(&item), false)
+			return s
+		}(),
+		"tampered":       "e30" + s[3:],
+		"no signature":   s[:len(s)-44],
+		"not base64":     "!!.!!",
+		"empty":          "",
+		"too many parts": s + ".x",
+	}
+	for name, c := range invalid {
+		if _, err := k.decode(c); err != ErrInvalidCursor {
+			t.Errorf("%s: err = %v, want ErrInvalidCursor", name, err)
+		}
+	}
+}
+
+func TestKeysetPaginate(t *testing.T) {
+	conn := openTestDB(t)
+	if err := conn.AutoMigrate(&keysetItem{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i, score := range []int{5, 3, 5, 1, 4} {
+		if err := conn.Create(&keysetItem{ID: uint64(i + 1), Score: score}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	k := Keyset{Columns: []KeysetColumn{{Name: "score", Desc: true}}, Secret: []byte("secret")}
+	ids := func(items []keysetItem) []uint64 {
+		var ids []uint64
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+		return ids
+	}
+
+	var first []keysetItem
+	page, err := k.Paginate(conn, server.CursorPagination{Limit: 2}, &first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids(first), []uint64{3, 1}) || page.HasPrev || !page.HasNext {
+		t.Fatalf("first page = %v %+v", ids(first), page)
+	}
+	var second []keysetItem
+	page, err = k.Paginate(conn, server.CursorPagination{Limit: 2, Cursor: page.NextCursor}, &second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids(second), []uint64{5, 2}) || !page.HasPrev || !page.HasNext {
+		t.Fatalf("second page = %v %+v", ids(second), page)
+	}
+	var back []keysetItem
+	page, err = k.Paginate(conn, server.CursorPagination{Limit: 2, Cursor: page.PrevCursor}, &back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids(back), []uint64{3, 1}) || page.HasPrev || !page.HasNext {
+		t.Fatalf("previous page = %v %+v", ids(back), page)
+	}
+
+	var items []keysetItem
+	if _, err := (Keyset{}).Paginate(conn, server.CursorPagination{}, &items); err != ErrNoCursorSecret {
+		t.Errorf("err = %v, want ErrNoCursorSecret", err)
+	}
+	if _, err := k.Paginate(conn, server.CursorPagination{Cursor: "bogus"}, &items); err != ErrInvalidCursor {
+		t.Errorf("err = %v, want ErrInvalidCursor", err)
+	}
+}
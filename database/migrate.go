@@ -0,0 +1,531 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+)
+
+const (
+	MigrationTable           = "schema_migrations"
+	DefaultMigrationLockWait = time.Minute
+	lockPollInterval         = time.Second
+)
+
+// Migration is one versioned schema change, either Go functions or SQL.
+// Versions are usually timestamps like 20200601120000.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+	UpSQL   string
+	DownSQL string
+	// DisableTx runs the migration outside a transaction, for statements
+	// like CREATE INDEX CONCURRENTLY. MySQL never uses one since its DDL
+	// commits implicitly.
+	DisableTx bool
+}
+
+// SchemaMigration is a row of the migration history table.
+type SchemaMigration struct {
+	Version   int64  `gorm:"primary_key;auto_increment:false"`
+	Name      string `gorm:"size:255"`
+	Checksum  string `gorm:"size:64"`
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return MigrationTable
+}
+
+type MigrationStatus struct {
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	// Changed is set when an applied migration was edited afterwards.
+	Changed bool `json:"changed"`
+	// Missing is set when an applied migration is no longer registered.
+	Missing bool `json:"missing"`
+}
+
+type Migrator struct {
+	db         *Database
+	migrations []Migration
+	// LockWait is how long to wait for another replica to finish migrating.
+	LockWait time.Duration
+}
+
+func NewMigrator(db *Database, migrations ...Migration) *Migrator {
+	m := &Migrator{db: db, LockWait: DefaultMigrationLockWait}
+	m.Add(migrations...)
+	return m
+}
+
+func (m *Migrator) Add(migrations ...Migration) {
+	m.migrations = append(m.migrations, migrations...)
+	sort.Slice(m.migrations, func(i, j int) bool {
+		return m.migrations[i].Version < m.migrations[j].Version
+	})
+}
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// LoadSQL registers the files of dir named like 20200601120000_name.up.sql
+// and 20200601120000_name.down.sql.
+func (m *Migrator) LoadSQL(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	found := map[int64]*Migration{}
+	for _, f := range files {
+		match := migrationFile.FindStringSubmatch(f.Name())
+		if f.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return err
+		}
+		mg, ok := found[version]
+		if !ok {
+			mg = &Migration{Version: version, Name: match[2]}
+			found[version] = mg
+		}
+		if match[3] == "up" {
+			mg.UpSQL = string(b)
+		} else {
+			mg.DownSQL = string(b)
+		}
+	}
+	for _, mg := range found {
+		m.Add(*mg)
+	}
+	return nil
+}
+
+// Up applies every pending migration in version order.
+func (m *Migrator) Up() error {
+	return m.locked(func() error {
+		applied, err := m.applied()
+		if err != nil {
+			return err
+		}
+		for _, mg := range m.migrations {
+			if rec, ok := applied[mg.Version]; ok {
+				if rec.Checksum != mg.checksum() {
+					return fmt.Errorf("migration %d %s was changed after it was applied", mg.Version, mg.Name)
+				}
+				continue
+			}
+			if err := m.apply(mg, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Down rolls back the last n applied migrations, n must be at least 1.
+func (m *Migrator) Down(n int) error {
+	if n < 1 {
+		return fmt.Errorf("migrations to roll back must be at least 1, got %d", n)
+	}
+	return m.locked(func() error {
+		applied, err := m.applied()
+		if err != nil {
+			return err
+		}
+		versions := make([]int64, 0, len(applied))
+		for v := range applied {
+			versions = append(versions, v)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+		if n > len(versions) {
+			n = len(versions)
+		}
+		for _, v := range versions[:n] {
+			mg, ok := m.find(v)
+			if !ok {
+				return fmt.Errorf("migration %d is applied but not registered", v)
+			}
+			if err := m.apply(mg, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var status []MigrationStatus
+	for _, mg := range m.migrations {
+		s := MigrationStatus{Version: mg.Version, Name: mg.Name}
+		if rec, ok := applied[mg.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = &rec.AppliedAt
+			s.Changed = rec.Checksum != mg.checksum()
+			delete(applied, mg.Version)
+		}
+		status = append(status, s)
+	}
+	for _, rec := range applied {
+		rec := rec
+		status = append(status, MigrationStatus{
+			Version:   rec.Version,
+			Name:      rec.Name,
+			Applied:   true,
+			AppliedAt: &rec.AppliedAt,
+			Missing:   true,
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+	return status, nil
+}
+
+// Command runs a migrate command line, "up", "down [n]" or "status", the
+// status is printed to stdout.
+func (m *Migrator) Command(args ...string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing migrate command, use up, down [n] or status")
+	}
+	switch args[0] {
+	case "up":
+		return m.Up()
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps %s", args[1])
+			}
+		}
+		return m.Down(n)
+	case "status":
+		status, err := m.Status()
+		if err != nil {
+			return err
+		}
+		return printMigrationStatus(os.Stdout, status)
+	}
+	return fmt.Errorf("unknown migrate command %s", args[0])
+}
+
+func (m *Migrator) apply(mg Migration, up bool) error {
+	direction := "up"
+	if !up {
+		direction = "down"
+	}
+	start := time.Now()
+	run := func(tx *gorm.DB) error {
+		if err := mg.run(tx, up); err != nil {
+			return err
+		}
+		if !up {
+			return tx.Delete(&SchemaMigration{Version: mg.Version}).Error
+		}
+		return tx.Create(&SchemaMigration{
+			Version:   mg.Version,
+			Name:      mg.Name,
+			Checksum:  mg.checksum(),
+			AppliedAt: time.Now(),
+		}).Error
+	}
+	var err error
+	if mg.DisableTx || m.db.Ctx.Dialect().GetName() == MySQL {
+		err = run(m.db.Ctx)
+	} else {
+		tx := m.db.Ctx.Begin()
+		if err = run(tx); err != nil {
+			_ = tx.Rollback()
+		} else {
+			err = tx.Commit().Error
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("migration %d %s %s: %v", mg.Version, mg.Name, direction, err)
+	}
+	log.Infof("Migration %d %s %s done in %v", mg.Version, mg.Name, direction, time.Since(start))
+	return nil
+}
+
+func (m *Migrator) applied() (map[int64]SchemaMigration, error) {
+	if err := m.db.Ctx.AutoMigrate(&SchemaMigration{}).Error; err != nil {
+		return nil, err
+	}
+	var records []SchemaMigration
+	if err := m.db.Ctx.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	applied := map[int64]SchemaMigration{}
+	for _, rec := range records {
+		applied[rec.Version] = rec
+	}
+	return applied, nil
+}
+
+func (m *Migrator) find(version int64) (Migration, bool) {
+	for _, mg := range m.migrations {
+		if mg.Version == version {
+			return mg, true
+		}
+	}
+	return Migration{}, false
+}
+
+// locked makes sure only one replica migrates at a time.
+func (m *Migrator) locked(fn func() error) error {
+	return m.db.withLock(context.Background(), fmt.Sprintf("%s:%s", MigrationTable, m.db.Config.Name), m.LockWait, fn)
+}
+
+var errLockTimeout = errors.New("timeout waiting for lock")
+
+// withLock runs fn while holding the named database level lock, waiting at
+// most wait for it or until ctx is done.
+func (db *Database) withLock(ctx context.Context, name string, wait time.Duration, fn func() error) error {
+	dialect := db.Ctx.Dialect().GetName()
+	if dialect != MySQL && dialect != PostgreSQL && dialect != MSSQL {
+		// SQLite locks the whole file on write
+		return fn()
+	}
+	ctx, cancel := context.WithTimeout(ctx, wait+DefaultHealthTimeout)
+	defer cancel()
+	conn, err := db.Ctx.DB().Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := acquireLock(ctx, conn, dialect, name, wait); err != nil {
+		return err
+	}
+	defer func() {
+		if err := releaseLock(conn, dialect, name); err != nil {
+			log.Errorf("Database unlock %s error -: %v", name, err)
+		}
+	}()
+	return fn()
+}
+
+func acquireLock(ctx context.Context, conn *sql.Conn, dialect string, name string, wait time.Duration) error {
+	var ok bool
+	var err error
+	switch dialect {
+	case MySQL:
+		var n sql.NullInt64
+		err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, int(wait.Seconds())).Scan(&n)
+		ok = n.Valid && n.Int64 == 1
+	case PostgreSQL:
+		deadline := time.Now().Add(wait)
+		for {
+			if err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lockID(name)).Scan(&ok); err != nil || ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				return errLockTimeout
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(lockPollInterval):
+			}
+		}
+	case MSSQL:
+		var n int
+		err = conn.QueryRowContext(ctx, "DECLARE @r int; EXEC @r = sp_getapplock @Resource = @p1, @LockMode = 'Exclusive', @LockOwner = 'Session', @LockTimeout = @p2; SELECT @r",
+			name, wait.Milliseconds()).Scan(&n)
+		ok = n >= 0
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errLockTimeout
+	}
+	return nil
+}
+
+func releaseLock(conn *sql.Conn, dialect string, name string) error {
+	ctx := context.Background()
+	var err error
+	switch dialect {
+	case MySQL:
+		_, err = conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", name)
+	case PostgreSQL:
+		_, err = conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", lockID(name))
+	case MSSQL:
+		_, err = conn.ExecContext(ctx, "EXEC sp_releaseapplock @Resource = @p1, @LockOwner = 'Session'", name)
+	}
+	return err
+}
+
+func lockID(name string) int64 {
+	h := fnv.New64a()
+	_, _ = io.WriteString(h, name)
+	return int64(h.Sum64())
+}
+
+func (mg Migration) run(tx *gorm.DB, up bool) error {
+	fn, script := mg.Up, mg.UpSQL
+	if !up {
+		fn, script = mg.Down, mg.DownSQL
+	}
+	if fn != nil {
+		return fn(tx)
+	}
+	if script == "" {
+		if up {
+			return fmt.Errorf("no up migration")
+		}
+		return fmt.Errorf("no down migration")
+	}
+	for _, stmt := range splitStatements(script, tx.Dialect().GetName()) {
+		if err := tx.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checksum covers the name and SQL of a migration, Go functions can not be
+// hashed so only their name is checked.
+func (mg Migration) checksum() string {
+	h := sha256.New()
+	_, _ = io.WriteString(h, mg.Name+"\x00"+mg.UpSQL+"\x00"+mg.DownSQL)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// splitStatements splits script on semicolons outside of quotes and
+// comments, drivers mostly execute a single statement per call. Backslash
+// escapes in strings are MySQL only and dollar quoted bodies PostgreSQL only.
+func splitStatements(script string, dialect string) []string {
+	var stmts []string
+	var current strings.Builder
+	var quote rune
+	var dollarTag string
+	runes := []rune(script)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case dollarTag != "":
+			if c == '$' && strings.HasPrefix(string(runes[i:]), dollarTag) {
+				current.WriteString(dollarTag)
+				i += len([]rune(dollarTag)) - 1
+				dollarTag = ""
+				continue
+			}
+		case quote != 0:
+			if c == '\\' && dialect == MySQL && quote != '`' && i+1 < len(runes) {
+				current.WriteRune(c)
+				i++
+				c = runes[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '$' && dialect == PostgreSQL:
+			if tag := dollarQuoteTag(runes, i); tag != "" {
+				dollarTag = tag
+				current.WriteString(tag)
+				i += len([]rune(tag)) - 1
+				continue
+			}
+		case c == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for i+1 < len(runes) && runes[i+1] != '\n' {
+				i++
+			}
+			continue
+		case c == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			// kept, MySQL runs the content of /*! */ comments
+			rest := string(runes[i+2:])
+			end := strings.Index(rest, "*/")
+			if end < 0 {
+				current.WriteString("/*" + rest)
+				i = len(runes)
+				continue
+			}
+			comment := "/*" + rest[:end+2]
+			current.WriteString(comment)
+			i += len([]rune(comment)) - 1
+			continue
+		case c == ';':
+			if stmt := strings.TrimSpace(current.String()); stmt != "" {
+				stmts = append(stmts, stmt)
+			}
+			current.Reset()
+			continue
+		}
+		current.WriteRune(c)
+	}
+	if stmt := strings.TrimSpace(current.String()); stmt != "" {
+		stmts = append(stmts, stmt)
+	}
+	return stmts
+}
+
+// dollarQuoteTag returns the $tag$ opening a dollar quoted string at i, or
+// an empty string when there is none, for example for a $1 parameter.
+func dollarQuoteTag(runes []rune, i int) string {
+	if i > 0 && (unicode.IsLetter(runes[i-1]) || unicode.IsDigit(runes[i-1]) || runes[i-1] == '_') {
+		return ""
+	}
+	for j := i + 1; j < len(runes); j++ {
+		c := runes[j]
+		switch {
+		case c == '$':
+			return string(runes[i : j+1])
+		case unicode.IsLetter(c) || c == '_' || (unicode.IsDigit(c) && j > i+1):
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+func printMigrationStatus(w io.Writer, status []MigrationStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+	for _, s := range status {
+		state, at := "pending", ""
+		switch {
+		case s.Missing:
+			state = "missing"
+		case s.Changed:
+			state = "changed"
+		case s.Applied:
+			state = "applied"
+		}
+		if s.AppliedAt != nil {
+			at = s.AppliedAt.Format(time.RFC3339)
+		}
+		_, _ = fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", s.Version, s.Name, state, at)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,91 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect string
+		script  string
+		want    []string
+	}{
+		{
+			name:    "statements",
+			dialect: MySQL,
+			script:  "CREATE TABLE a (id int);\n\nINSERT INTO a VALUES (1);  ",
+			want:    []string{"CREATE TABLE a (id int)", "INSERT INTO a VALUES (1)"},
+		},
+		{
+			name:    "quotes",
+			dialect: SQLite,
+			script:  "INSERT INTO a VALUES ('x;y', \"b;c\", 'it''s;');SELECT 1",
+			want:    []string{"INSERT INTO a VALUES ('x;y', \"b;c\", 'it''s;')", "SELECT 1"},
+		},
+		{
+			name:    "line comments",
+			dialect: PostgreSQL,
+			script:  "-- first; not a statement\nSELECT 1; -- trailing;\nSELECT 2",
+			want:    []string{"SELECT 1", "SELECT 2"},
+		},
+		{
+			name:    "block comments",
+			dialect: MySQL,
+			script:  "/* a; b */ SELECT 1; /*!40101 SET NAMES utf8mb4 */;SELECT 2 /* open;",
+			want:    []string{"/* a; b */ SELECT 1", "/*!40101 SET NAMES utf8mb4 */", "SELECT 2 /* open;"},
+		},
+		{
+			name:    "mysql backslash escapes",
+			dialect: MySQL,
+			script:  `INSERT INTO a VALUES ('it\'s; x', "a\"; b", 'c\\');SELECT 1`,
+			want:    []string{`INSERT INTO a VALUES ('it\'s; x', "a\"; b", 'c\\')`, "SELECT 1"},
+		},
+		{
+			name:    "postgres backslash is literal",
+			dialect: PostgreSQL,
+			script:  `INSERT INTO a VALUES ('c:\');SELECT 1`,
+			want:    []string{`INSERT INTO a VALUES ('c:\')`, "SELECT 1"},
+		},
+		{
+			name:    "dollar quoting",
+			dialect: PostgreSQL,
+			script: "CREATE FUNCTION f() RETURNS trigger AS $$ BEGIN NEW.a := 1; RETURN NEW; END; $$ LANGUAGE plpgsql;\n" +
+				"DO $body$ BEGIN PERFORM 'x$$;'; END $body$;SELECT $1",
+			want: []string{
+				"CREATE FUNCTION f() RETURNS trigger AS $$ BEGIN NEW.a := 1; RETURN NEW; END; $$ LANGUAGE plpgsql",
+				"DO $body$ BEGIN PERFORM 'x$$;'; END $body$",
+				"SELECT $1",
+			},
+		},
+		{
+			name:    "dollar in identifiers",
+			dialect: PostgreSQL,
+			script:  "SELECT a$b$c FROM t;SELECT 2",
+			want:    []string{"SELECT a$b$c FROM t", "SELECT 2"},
+		},
+		{
+			name:    "empty",
+			dialect: MySQL,
+			script:  " ;\n-- only a comment\n;",
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitStatements(tt.script, tt.dialect); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitStatements() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigratorDownInvalidCount(t *testing.T) {
+	m := NewMigrator(&Database{Ctx: openTestDB(t)})
+	for _, n := range []int{0, -1} {
+		if err := m.Down(n); err == nil {
+			t.Errorf("Down(%d): expected an error", n)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	"github.com/jinzhu/gorm"
+	"github.com/patcharp/go_swth/cache"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultOutboxPollInterval    = time.Second
+	DefaultOutboxBatchSize       = 100
+	DefaultOutboxMaxAttempts     = 20
+	DefaultOutboxMinBackoff      = time.Second
+	DefaultOutboxMaxBackoff      = 5 * time.Minute
+	DefaultOutboxRetention       = 7 * 24 * time.Hour
+	DefaultOutboxCleanupInterval = time.Hour
+	outboxLockName               = "outbox_relay"
+)
+
+// OutboxEvent is an event stored with the business data and published by
+// an OutboxRelay. Delivery is at least once, consumers dedupe by ID.
+type OutboxEvent struct {
+	ID            uint64     `gorm:"primary_key" json:"id"`
+	AggregateType string     `gorm:"size:64;index:idx_outbox_events_aggregate" json:"aggregate_type"`
+	AggregateID   string     `gorm:"size:64;index:idx_outbox_events_aggregate" json:"aggregate_id"`
+	Type          string     `gorm:"size:128" json:"type"`
+	Payload       string     `gorm:"type:text" json:"payload"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `gorm:"type:text" json:"last_error,omitempty"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	SentAt        *time.Time `gorm:"index" json:"sent_at,omitempty"`
+	// FailedAt is set when the event gave up after MaxAttempts, it is not
+	// published again unless retried.
+	FailedAt  *time.Time `gorm:"index" json:"failed_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (OutboxEvent) TableName() string {
+	return "outbox_events"
+}
+
+// Decode unmarshals the payload into v.
+func (e OutboxEvent) Decode(v interface{}) error {
+	return json.Unmarshal([]byte(e.Payload), v)
+}
+
+// AddOutboxEvent stores an event in tx, so it is only published when the
+// transaction commits.
+func AddOutboxEvent(tx *gorm.DB, aggregateType string, aggregateID string, eventType string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&OutboxEvent{
+		AggregateType: aggregateType,
+		AggregateID:   aggregateID,
+		Type:          eventType,
+		Payload:       string(b),
+		NextAttemptAt: time.Now(),
+	}).Error
+}
+
+type Publisher interface {
+	Publish(ctx context.Context, event OutboxEvent) error
+}
+
+type PublisherFunc func(ctx context.Context, event OutboxEvent) error
+
+func (f PublisherFunc) Publish(ctx context.Context, event OutboxEvent) error {
+	return f(ctx, event)
+}
+
+// RedisStreamPublisher appends events to a redis stream, one entry per
+// event with its fields as stream values.
+func RedisStreamPublisher(r *cache.Redis, stream string) Publisher {
+	return PublisherFunc(func(ctx context.Context, e OutboxEvent) error {
+		return r.Client.WithContext(ctx).XAdd(&redis.XAddArgs{
+			Stream: r.Key(stream, nil),
+			Values: map[string]interface{}{
+				"id":             strconv.FormatUint(e.ID, 10),
+				"aggregate_type": e.AggregateType,
+				"aggregate_id":   e.AggregateID,
+				"type":           e.Type,
+				"payload":        e.Payload,
+			},
+		}).Err()
+	})
+}
+
+type OutboxConfig struct {
+	PollInterval time.Duration
+	BatchSize    int
+	// MaxAttempts is how many times an event is tried before it is marked
+	// as failed, so it stops holding back its aggregate.
+	MaxAttempts int
+	// MinBackoff and MaxBackoff bound the delay before a failed event is
+	// tried again, doubling after every attempt.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Retention is how long sent events are kept before cleanup.
+	Retention       time.Duration
+	CleanupInterval time.Duration
+}
+
+// OutboxRelay publishes stored events in order per aggregate. A failed
+// event holds back the later events of its aggregate until it is sent or
+// has failed MaxAttempts times.
+// Events are ordered by id, which is assigned on insert. Two transactions
+// writing the same aggregate that commit in the opposite order of their
+// inserts can be published out of order, so writes to one aggregate should be
+// serialized, e.g. by locking its row, when order matters.
+// Replicas take turns through a database lock, so only one relays at a time.
+type OutboxRelay struct {
+	db        *Database
+	publisher Publisher
+	config    OutboxConfig
+	notify    chan struct{}
+	mu        sync.Mutex
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+func NewOutboxRelay(db *Database, publisher Publisher, config OutboxConfig) *OutboxRelay {
+	if config.PollInterval <= 0 {
+		config.PollInterval = DefaultOutboxPollInterval
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultOutboxBatchSize
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultOutboxMaxAttempts
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = DefaultOutboxMinBackoff
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = DefaultOutboxMaxBackoff
+	}
+	if config.Retention <= 0 {
+		config.Retention = DefaultOutboxRetention
+	}
+	if config.CleanupInterval <= 0 {
+		config.CleanupInterval = DefaultOutboxCleanupInterval
+	}
+	return &OutboxRelay{
+		db:        db,
+		publisher: publisher,
+		config:    config,
+		notify:    make(chan struct{}, 1),
+	}
+}
+
+// Start creates the outbox table when missing and relays in the background
+// until Stop is called.
+func (o *OutboxRelay) Start() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.cancel != nil {
+		return nil
+	}
+	if err := o.db.Ctx.AutoMigrate(&OutboxEvent{}).Error; err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	o.cancel = cancel
+	o.done = make(chan struct{})
+	go o.run(ctx)
+	return nil
+}
+
+func (o *OutboxRelay) Stop() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.cancel == nil {
+		return
+	}
+	o.cancel()
+	<-o.done
+	o.cancel = nil
+}
+
+// Notify wakes the relay up without waiting for the next poll, for example
+// right after committing a transaction with events.
+func (o *OutboxRelay) Notify() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (o *OutboxRelay) run(ctx context.Context) {
+	defer close(o.done)
+	lastCleanup := time.Now()
+	for {
+		if _, err := o.Process(ctx); err != nil && err != errLockTimeout && ctx.Err() == nil {
+			log.Errorln("Outbox relay error -:", err)
+		}
+		if time.Since(lastCleanup) >= o.config.CleanupInterval {
+			if _, err := o.Cleanup(); err != nil {
+				log.Errorln("Outbox cleanup error -:", err)
+			}
+			lastCleanup = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.notify:
+		case <-time.After(o.config.PollInterval):
+		}
+	}
+}
+
+// Process publishes the pending events until none is due and returns how
+// many were sent. Every round takes only the oldest pending event of each
+// aggregate, so aggregates that are backing off do not hold back others.
+func (o *OutboxRelay) Process(ctx context.Context) (int, error) {
+	sent := 0
+	err := o.db.withLock(ctx, fmt.Sprintf("%s:%s", outboxLockName, o.db.Config.Name), 0, func() error {
+		for ctx.Err() == nil {
+			var events []OutboxEvent
+			oldest := o.db.Ctx.Model(&OutboxEvent{}).
+				Select("MIN(id)").
+				Where("sent_at IS NULL AND failed_at IS NULL").
+				Group("aggregate_type, aggregate_id")
+			err := o.db.Ctx.
+				Where("id IN (?) AND next_attempt_at <= ?", oldest.QueryExpr(), time.Now()).
+				Order("id").
+				Limit(o.config.BatchSize).
+				Find(&events).Error
+			if err != nil {
+				return err
+			}
+			if len(events) == 0 {
+				return nil
+			}
+			for _, e := range events {
+				if ctx.Err() != nil {
+					return nil
+				}
+				ok, err := o.publish(ctx, e)
+				if err != nil {
+					return err
+				}
+				if ok {
+					sent++
+				}
+			}
+		}
+		return nil
+	})
+	return sent, err
+}
+
+// Retry publishes a failed event again.
+func (o *OutboxRelay) Retry(id uint64) error {
+	return o.db.Ctx.Model(&OutboxEvent{ID: id}).Updates(map[string]interface{}{
+		"attempts":        0,
+		"failed_at":       nil,
+		"next_attempt_at": time.Now(),
+	}).Error
+}
+
+// publish reports whether e was sent, the error is only set when the result
+// could not be stored.
+func (o *OutboxRelay) publish(ctx context.Context, e OutboxEvent) (bool, error) {
+	now := time.Now()
+	if err := o.publisher.Publish(ctx, e); err != nil {
+		log.Errorf("Outbox publish %d error -: %v", e.ID, err)
+		updates := map[string]interface{}{
+			"attempts":   e.Attempts + 1,
+			"last_error": err.Error(),
+		}
+		if e.Attempts+1 >= o.config.MaxAttempts {
+			log.Errorf("Outbox event %d failed after %d attempts", e.ID, e.Attempts+1)
+			updates["failed_at"] = &now
+		} else {
+			backoff := o.config.MinBackoff << uint(e.Attempts)
+			if backoff > o.config.MaxBackoff || backoff <= 0 {
+				backoff = o.config.MaxBackoff
+			}
+			updates["next_attempt_at"] = now.Add(backoff)
+		}
+		return false, o.db.Ctx.Model(&e).Updates(updates).Error
+	}
+	return true, o.db.Ctx.Model(&e).Updates(map[string]interface{}{
+		"attempts":   e.Attempts + 1,
+		"last_error": "",
+		"sent_at":    &now,
+	}).Error
+}
+
+// Cleanup deletes the events sent longer than the retention ago.
+func (o *OutboxRelay) Cleanup() (int64, error) {
+	res := o.db.Ctx.
+		Where("sent_at IS NOT NULL AND sent_at < ?", time.Now().Add(-o.config.Retention)).
+		Delete(&OutboxEvent{})
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/patcharp/go_swth/server"
+	"reflect"
+)
+
+// Page is the result envelope of Paginate, meant as server.ApiResult Data.
+type Page struct {
+	Items      interface{} `json:"items"`
+	Page       uint        `json:"page"`
+	Size       uint        `json:"size"`
+	Total      int64       `json:"total"`
+	TotalPages uint        `json:"total_pages"`
+	HasNext    bool        `json:"has_next"`
+	HasPrev    bool        `json:"has_prev"`
+}
+
+// PaginateScope limits a query to page p, use it with gorm's Scopes.
+func PaginateScope(p server.Pagination) func(db *gorm.DB) *gorm.DB {
+	p = normalizePagination(p)
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Offset(p.Offset()).Limit(p.Size)
+	}
+}
+
+// Paginate counts the rows of query and loads page p of them into dest,
+// a pointer to a slice. The items query is skipped when the page is past
+// the last row.
+func Paginate(query *gorm.DB, p server.Pagination, dest interface{}) (Page, error) {
+	p = normalizePagination(p)
+	page := Page{Items: dest, Page: p.Page, Size: p.Size}
+	if err := query.Model(dest).Count(&page.Total).Error; err != nil {
+		return page, err
+	}
+	page.TotalPages = uint((page.Total + int64(p.Size) - 1) / int64(p.Size))
+	page.HasPrev = p.Page > 1
+	page.HasNext = p.Page < page.TotalPages
+	if int64(p.Offset()) >= page.Total {
+		// keep items an empty list rather than null in JSON
+		v := reflect.ValueOf(dest).Elem()
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		return page, nil
+	}
+	if err := query.Scopes(PaginateScope(p)).Find(dest).Error; err != nil {
+		return page, err
+	}
+	return page, nil
+}
+
+func normalizePagination(p server.Pagination) server.Pagination {
+	if p.Page == 0 {
+		p.Page = server.DefaultQueryPage
+	}
+	if p.Size == 0 {
+		p.Size = server.DefaultQuerySize
+	}
+	return p
+}
@@ -0,0 +1,188 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+type Operator string
+
+const (
+	Eq      Operator = "eq"
+	Ne      Operator = "ne"
+	In      Operator = "in"
+	Like    Operator = "like"
+	Gt      Operator = "gt"
+	Gte     Operator = "gte"
+	Lt      Operator = "lt"
+	Lte     Operator = "lte"
+	Between Operator = "between"
+)
+
+var operatorSQL = map[Operator]string{
+	Eq:  "=",
+	Ne:  "<>",
+	Gt:  ">",
+	Gte: ">=",
+	Lt:  "<",
+	Lte: "<=",
+}
+
+// QuerySchema whitelists what clients may filter, sort and search on, keyed
+// by the names used in the query string.
+type QuerySchema struct {
+	Filters map[string]FilterField
+	Sorts   map[string]string
+	// Search are the columns matched by q with LIKE.
+	Search []string
+	// DefaultSort is used without sort param, for example "-created_at".
+	DefaultSort string
+}
+
+type FilterField struct {
+	Column string
+	// Operators allowed on the field, default is Eq only.
+	Operators []Operator
+}
+
+// QuerySpec is a parsed list query, apply it with gorm's Scopes.
+type QuerySpec struct {
+	Filters []Filter
+	Sorts   []Sort
+	Search  string
+	search  []string
+}
+
+type Filter struct {
+	Column string
+	Op     Operator
+	Values []string
+}
+
+type Sort struct {
+	Column string
+	Desc   bool
+}
+
+var filterParam = regexp.MustCompile(`^filter\[([^\]]+)\](?:\[([^\]]+)\])?$`)
+
+// Parse reads filter[field]=v, filter[field][op]=v, sort=-a,b and q from
+// values. In and between take comma separated values.
+func (s QuerySchema) Parse(values url.Values) (QuerySpec, error) {
+	spec := QuerySpec{Search: strings.TrimSpace(values.Get("q")), search: s.Search}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		match := filterParam.FindStringSubmatch(k)
+		if match == nil {
+			continue
+		}
+		field, ok := s.Filters[match[1]]
+		if !ok {
+			return spec, fmt.Errorf("%w: unknown filter %s", ErrInvalidQuery, match[1])
+		}
+		op := Eq
+		if match[2] != "" {
+			op = Operator(strings.ToLower(match[2]))
+		}
+		if !field.allows(op) {
+			return spec, fmt.Errorf("%w: operator %s is not allowed on %s", ErrInvalidQuery, op, match[1])
+		}
+		f := Filter{Column: field.Column, Op: op, Values: []string{values.Get(k)}}
+		if op == In || op == Between {
+			f.Values = strings.Split(values.Get(k), ",")
+		}
+		if op == Between && len(f.Values) != 2 {
+			return spec, fmt.Errorf("%w: between on %s needs two values", ErrInvalidQuery, match[1])
+		}
+		spec.Filters = append(spec.Filters, f)
+	}
+	sorts := values.Get("sort")
+	if sorts == "" {
+		sorts = s.DefaultSort
+	}
+	for _, name := range strings.Split(sorts, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		desc := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		column, ok := s.Sorts[name]
+		if !ok {
+			return spec, fmt.Errorf("%w: unknown sort %s", ErrInvalidQuery, name)
+		}
+		spec.Sorts = append(spec.Sorts, Sort{Column: column, Desc: desc})
+	}
+	return spec, nil
+}
+
+func (f FilterField) allows(op Operator) bool {
+	if len(f.Operators) == 0 {
+		return op == Eq
+	}
+	for _, o := range f.Operators {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Scope applies the filters, search and sorting of the spec to db.
+func (q QuerySpec) Scope(db *gorm.DB) *gorm.DB {
+	for _, f := range q.Filters {
+		column := quoteColumn(db, f.Column)
+		switch f.Op {
+		case In:
+			db = db.Where(column+" IN (?)", f.Values)
+		case Like:
+			db = db.Where(column+" LIKE ? ESCAPE '!'", "%"+escapeLike(f.Values[0])+"%")
+		case Between:
+			db = db.Where(column+" BETWEEN ? AND ?", f.Values[0], f.Values[1])
+		default:
+			db = db.Where(column+" "+operatorSQL[f.Op]+" ?", f.Values[0])
+		}
+	}
+	if q.Search != "" && len(q.search) > 0 {
+		var or []string
+		var args []interface{}
+		for _, c := range q.search {
+			or = append(or, quoteColumn(db, c)+" LIKE ? ESCAPE '!'")
+			args = append(args, "%"+escapeLike(q.Search)+"%")
+		}
+		db = db.Where("("+strings.Join(or, " OR ")+")", args...)
+	}
+	for _, s := range q.Sorts {
+		dir := " ASC"
+		if s.Desc {
+			dir = " DESC"
+		}
+		db = db.Order(quoteColumn(db, s.Column) + dir)
+	}
+	return db
+}
+
+func quoteColumn(db *gorm.DB, column string) string {
+	parts := strings.Split(column, ".")
+	for i, p := range parts {
+		parts[i] = db.Dialect().Quote(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// escapeLike uses ! as escape character, the backslash would need different
+// quoting on MySQL.
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
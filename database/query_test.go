@@ -0,0 +1,104 @@
+package database
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestQuerySchemaParse(t *testing.T) {
+	schema := QuerySchema{
+		Filters: map[string]FilterField{
+			"status": {Column: "status", Operators: []Operator{Eq, In}},
+			"age":    {Column: "people.age", Operators: []Operator{Gt, Between}},
+			"name":   {Column: "name"},
+		},
+		Sorts:       map[string]string{"age": "people.age", "name": "name"},
+		Search:      []string{"name"},
+		DefaultSort: "-age",
+	}
+	tests := []struct {
+		name    string
+		query   string
+		want    QuerySpec
+		invalid bool
+	}{
+		{
+			name:  "default sort",
+			query: "",
+			want:  QuerySpec{Sorts: []Sort{{Column: "people.age", Desc: true}}},
+		},
+		{
+			name:  "filters sorted by param",
+			query: "filter[status]=active&filter[age][gt]=30&filter[name]=bob&sort=name,-age&q=+al+",
+			want: QuerySpec{
+				Filters: []Filter{
+					{Column: "people.age", Op: Gt, Values: []string{"30"}},
+					{Column: "name", Op: Eq, Values: []string{"bob"}},
+					{Column: "status", Op: Eq, Values: []string{"active"}},
+				},
+				Sorts:  []Sort{{Column: "name"}, {Column: "people.age", Desc: true}},
+				Search: "al",
+			},
+		},
+		{
+			name:  "in and between split values",
+			query: "filter[status][IN]=a,b,c&filter[age][between]=20,30&sort=",
+			want: QuerySpec{
+				Filters: []Filter{
+					{Column: "people.age", Op: Between, Values: []string{"20", "30"}},
+					{Column: "status", Op: In, Values: []string{"a", "b", "c"}},
+				},
+				Sorts: []Sort{{Column: "people.age", Desc: true}},
+			},
+		},
+		{
+			name:  "other params are ignored",
+			query: "page=2&size=10&filters=x&sort=+name+,",
+			want:  QuerySpec{Sorts: []Sort{{Column: "name"}}},
+		},
+		{name: "unknown filter", query: "filter[password]=x", invalid: true},
+		{name: "operator not allowed", query: "filter[name][like]=x", invalid: true},
+		{name: "unknown operator", query: "filter[age][drop]=1", invalid: true},
+		{name: "between needs two values", query: "filter[age][between]=1", invalid: true},
+		{name: "unknown sort", query: "sort=-password", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := schema.Parse(values)
+			if tt.invalid {
+				if !errors.Is(err, ErrInvalidQuery) {
+					t.Errorf("err = %v, want ErrInvalidQuery", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want.search = schema.Search
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := map[string]string{
+		"plain":   "plain",
+		"50%":     "50!%",
+		"a_b":     "a!_b",
+		"wow!":    "wow!!",
+		`c:\dir%`: `c:\dir!%`,
+	}
+	for in, want := range tests {
+		if got := escapeLike(in); got != want {
+			t.Errorf("escapeLike(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"github.com/jinzhu/gorm"
+	"sync/atomic"
+)
+
+type ReplicaPolicy int
+
+const (
+	RoundRobin ReplicaPolicy = iota
+	// LeastLatency picks the replica with the fastest last health check.
+	LeastLatency
+)
+
+type replica struct {
+	config Config
+	ctx    *gorm.DB
+	health *healthMonitor
+}
+
+func openReplica(c Config, prod bool) (*replica, error) {
+	conn, err := open(c, prod)
+	if err != nil {
+		return nil, err
+	}
+	return &replica{config: c, ctx: conn, health: startHealthCheck(conn, c.Health)}, nil
+}
+
+func closeReplicas(replicas []*replica) {
+	for _, r := range replicas {
+		r.health.stop()
+		_ = r.ctx.Close()
+	}
+}
+
+// Read returns a healthy replica for read only queries, or the primary when
+// there is none.
+func (db *Database) Read() *gorm.DB {
+	var healthy []*replica
+	for _, r := range db.replicas {
+		if r.health.get().Healthy {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return db.Ctx
+	}
+	if db.ReplicaPolicy == LeastLatency {
+		best := healthy[0]
+		for _, r := range healthy[1:] {
+			if r.health.get().Latency < best.health.get().Latency {
+				best = r
+			}
+		}
+		return best.ctx
+	}
+	n := atomic.AddUint32(&db.next, 1)
+	return healthy[int(n)%len(healthy)].ctx
+}
+
+// Primary returns the primary connection, for reads that must see writes
+// made just before.
+func (db *Database) Primary() *gorm.DB {
+	return db.Ctx
+}
+
+// ReplicaHealth returns the health of every replica keyed by address, or
+// file name for SQLite.
+func (db *Database) ReplicaHealth() map[string]HealthStatus {
+	status := map[string]HealthStatus{}
+	for _, r := range db.replicas {
+		key := r.config.addr()
+		if r.config.driver() == SQLite {
+			key = r.config.Name
+		}
+		status[key] = r.health.get()
+	}
+	return status
+}
+
+// inherit fills the empty connection fields of a replica config from the
+// primary config.
+func (c Config) inherit(primary Config) Config {
+	if c.Driver == "" {
+		c.Driver = primary.Driver
+	}
+	if c.Port == "" {
+		c.Port = primary.Port
+	}
+	if c.Username == "" {
+		c.Username, c.Password = primary.Username, primary.Password
+	}
+	if c.Name == "" {
+		c.Name = primary.Name
+	}
+	if c.Options == nil {
+		c.Options = primary.Options
+	}
+	if c.Charset == "" && c.Collation == "" {
+		c.Charset, c.Collation = primary.Charset, primary.Collation
+	}
+	if c.Location == nil {
+		c.Location = primary.Location
+	}
+	if c.TLS == nil {
+		c.TLS = primary.TLS
+	}
+	if c.ConnectTimeout == 0 {
+		c.ConnectTimeout = primary.ConnectTimeout
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = primary.ReadTimeout
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = primary.WriteTimeout
+	}
+	if c.MaxOpenConns == 0 {
+		c.MaxOpenConns = primary.MaxOpenConns
+	}
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = primary.MaxIdleConns
+	}
+	if c.ConnMaxLifetime == 0 {
+		c.ConnMaxLifetime = primary.ConnMaxLifetime
+	}
+	if c.ConnMaxIdleTime == 0 {
+		c.ConnMaxIdleTime = primary.ConnMaxIdleTime
+	}
+	return c
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/patcharp/go_swth/server"
+	"net/url"
+	"reflect"
+)
+
+// Repository provides the common list and CRUD operations of a model.
+type Repository struct {
+	db     *Database
+	tx     *gorm.DB
+	model  reflect.Type
+	Schema QuerySchema
+}
+
+// NewRepository creates a repository of the type of model, for example
+// NewRepository(db, User{}, schema).
+func NewRepository(db *Database, model interface{}, schema QuerySchema) *Repository {
+	t := reflect.TypeOf(model)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return &Repository{db: db, model: t, Schema: schema}
+}
+
+// In returns a copy of the repository working inside tx.
+func (r *Repository) In(tx *gorm.DB) *Repository {
+	c := *r
+	c.tx = tx
+	return &c
+}
+
+// Find loads page p of the rows matching spec into dest, a pointer to a
+// slice. Outside a transaction it reads from a replica.
+func (r *Repository) Find(spec QuerySpec, p server.Pagination, dest interface{}) (Page, error) {
+	return Paginate(r.conn(true).Model(r.newModel()).Scopes(spec.Scope), p, dest)
+}
+
+// FindQuery parses values with the repository schema and calls Find,
+// errors wrapping ErrInvalidQuery are client errors.
+func (r *Repository) FindQuery(values url.Values, p server.Pagination, dest interface{}) (Page, error) {
+	spec, err := r.Schema.Parse(values)
+	if err != nil {
+		return Page{}, err
+	}
+	return r.Find(spec, p, dest)
+}
+
+// Get loads the row with primary key id into dest from the primary,
+// gorm.ErrRecordNotFound when there is none.
+func (r *Repository) Get(id interface{}, dest interface{}) error {
+	return r.conn(false).First(dest, r.pkCondition(), id).Error
+}
+
+func (r *Repository) Create(v interface{}) error {
+	return r.conn(false).Create(v).Error
+}
+
+// Update saves all fields of v.
+func (r *Repository) Update(v interface{}) error {
+	return r.conn(false).Save(v).Error
+}
+
+// Patch updates only the given columns of the row with primary key id.
+func (r *Repository) Patch(id interface{}, fields map[string]interface{}) error {
+	return r.conn(false).Model(r.newModel()).Where(r.pkCondition(), id).Updates(fields).Error
+}
+
+func (r *Repository) Delete(id interface{}) error {
+	return r.conn(false).Where(r.pkCondition(), id).Delete(r.newModel()).Error
+}
+
+func (r *Repository) conn(read bool) *gorm.DB {
+	if r.tx != nil {
+		return r.tx
+	}
+	if read {
+		return r.db.Read()
+	}
+	return r.db.Primary()
+}
+
+func (r *Repository) newModel() interface{} {
+	return reflect.New(r.model).Interface()
+}
+
+func (r *Repository) pkCondition() string {
+	scope := r.db.Ctx.NewScope(r.newModel())
+	return scope.Quote(scope.PrimaryKey()) + " = ?"
+}
@@ -0,0 +1,171 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultTxRetries = 3
+	txDepthKey       = "database:tx_depth"
+	txRetryBackoff   = 20 * time.Millisecond
+)
+
+type txContextKeyType struct{}
+
+var txContextKey txContextKeyType
+
+type TxOptions struct {
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+	// MaxRetries on deadlocks and serialization failures, default is
+	// DefaultTxRetries, a negative value disables retrying.
+	MaxRetries int
+}
+
+// WithTx runs fn in a transaction on the primary, see Transaction. When ctx
+// carries a transaction from ContextWithTx fn joins it through a savepoint,
+// otherwise a nested call opens a second, independent transaction.
+func (db *Database) WithTx(ctx context.Context, opts *TxOptions, fn func(tx *gorm.DB) error) error {
+	conn := db.Ctx
+	if tx, ok := TxFromContext(ctx); ok {
+		conn = tx
+	}
+	return Transaction(ctx, conn, opts, fn)
+}
+
+// ContextWithTx returns ctx carrying tx, pass it to code that calls WithTx
+// so it runs inside tx.
+func ContextWithTx(ctx context.Context, tx *gorm.DB) context.Context {
+	return context.WithValue(ctx, txContextKey, tx)
+}
+
+// TxFromContext returns the transaction carried by ctx.
+func TxFromContext(ctx context.Context) (*gorm.DB, bool) {
+	tx, ok := ctx.Value(txContextKey).(*gorm.DB)
+	return tx, ok
+}
+
+// Transaction commits when fn returns nil and rolls back when it returns an
+// error or panics. The whole transaction is retried on deadlocks, lock wait
+// timeouts and serialization failures, so fn must not have side effects
+// outside the database. Called with a conn that is already a transaction
+// it runs fn inside a savepoint instead, opts are then ignored.
+func Transaction(ctx context.Context, conn *gorm.DB, opts *TxOptions, fn func(tx *gorm.DB) error) error {
+	if _, ok := conn.CommonDB().(*sql.Tx); ok {
+		return savepoint(conn, fn)
+	}
+	if opts == nil {
+		opts = &TxOptions{}
+	}
+	retries := opts.MaxRetries
+	if retries == 0 {
+		retries = DefaultTxRetries
+	}
+	for attempt := 0; ; attempt++ {
+		err := transaction(ctx, conn, opts, fn)
+		if err == nil || attempt >= retries || !IsRetryable(err) {
+			return err
+		}
+		backoff := txRetryBackoff<<uint(attempt) + time.Duration(rand.Int63n(int64(txRetryBackoff)))
+		log.Warnf("Transaction retry %d after %v error -: %v", attempt+1, backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func transaction(ctx context.Context, conn *gorm.DB, opts *TxOptions, fn func(tx *gorm.DB) error) (err error) {
+	tx := conn.BeginTx(ctx, &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	sqlTx := tx.CommonDB().(*sql.Tx)
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic in transaction: %v", p)
+		}
+		if err != nil {
+			if rbErr := sqlTx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+				log.Errorln("Transaction rollback error -:", rbErr)
+			}
+		}
+	}()
+	if err = fn(tx.Set(txDepthKey, 0)); err != nil {
+		return err
+	}
+	return sqlTx.Commit()
+}
+
+func savepoint(tx *gorm.DB, fn func(tx *gorm.DB) error) (err error) {
+	depth := 1
+	if v, ok := tx.Get(txDepthKey); ok {
+		depth = v.(int) + 1
+	}
+	name := fmt.Sprintf("sp_%d", depth)
+	mssqlDialect := tx.Dialect().GetName() == MSSQL
+	create, rollback := "SAVEPOINT "+name, "ROLLBACK TO SAVEPOINT "+name
+	if mssqlDialect {
+		create, rollback = "SAVE TRANSACTION "+name, "ROLLBACK TRANSACTION "+name
+	}
+	if err := tx.New().Exec(create).Error; err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic in transaction: %v", p)
+		}
+		if err != nil {
+			if rbErr := tx.New().Exec(rollback).Error; rbErr != nil {
+				log.Errorln("Savepoint rollback error -:", rbErr)
+			}
+		}
+	}()
+	if err = fn(tx.Set(txDepthKey, depth)); err != nil {
+		return err
+	}
+	if mssqlDialect {
+		// SQL Server has no release, the savepoint ends with the transaction
+		return nil
+	}
+	return tx.New().Exec("RELEASE SAVEPOINT " + name).Error
+}
+
+// IsRetryable reports whether err is a deadlock, lock wait timeout or
+// serialization failure after which the transaction can be run again.
+func IsRetryable(err error) bool {
+	if errs, ok := err.(gorm.Errors); ok {
+		for _, e := range errs {
+			if IsRetryable(e) {
+				return true
+			}
+		}
+		return false
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		// ER_LOCK_DEADLOCK and ER_LOCK_WAIT_TIMEOUT
+		return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// serialization_failure and deadlock_detected
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	var mssqlErr mssql.Error
+	if errors.As(err, &mssqlErr) {
+		return mssqlErr.Number == 1205
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/jinzhu/gorm"
+	"testing"
+)
+
+type txItem struct {
+	ID   uint64
+	Name string
+}
+
+func TestWithTxNested(t *testing.T) {
+	db := &Database{Ctx: openTestDB(t)}
+	if err := db.Ctx.AutoMigrate(&txItem{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	errInner := errors.New("inner")
+	err := db.WithTx(ctx, nil, func(tx *gorm.DB) error {
+		if err := tx.Create(&txItem{Name: "outer"}).Error; err != nil {
+			return err
+		}
+		ctx := ContextWithTx(ctx, tx)
+		err := db.WithTx(ctx, nil, func(tx *gorm.DB) error {
+			if _, ok := tx.CommonDB().(*sql.Tx); !ok {
+				t.Error("nested call did not join the transaction")
+			}
+			if err := tx.Create(&txItem{Name: "rolled back"}).Error; err != nil {
+				return err
+			}
+			return errInner
+		})
+		if err != errInner {
+			t.Errorf("inner err = %v, want %v", err, errInner)
+		}
+		return db.WithTx(ctx, nil, func(tx *gorm.DB) error {
+			return tx.Create(&txItem{Name: "kept"}).Error
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	if err := db.Ctx.Model(&txItem{}).Order("id").Pluck("name", &names).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "outer" || names[1] != "kept" {
+		t.Errorf("names = %v, want [outer kept]", names)
+	}
+}
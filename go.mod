@@ -1,10 +1,11 @@
 module github.com/patcharp/go_swth
 
-go 1.14
+go 1.15
 
 require (
 	github.com/Depado/ginprom v1.3.0
-	github.com/carlescere/scheduler v0.0.0-20170109141437-ee74d2f83d82
+	github.com/alicebob/miniredis/v2 v2.30.0
+	github.com/denisenkom/go-mssqldb v0.0.0-20191124224453-732737034ffd
 	github.com/disintegration/imaging v1.6.2
 	github.com/facebookgo/clock v0.0.0-20150410010913-600d898af40a // indirect
 	github.com/facebookgo/ensure v0.0.0-20200202191622-63f1cf65ac4c // indirect
@@ -18,10 +19,13 @@ require (
 	github.com/gin-gonic/gin v1.6.2
 	github.com/globocom/echo-prometheus v0.1.2
 	github.com/go-redis/redis/v7 v7.2.0
+	github.com/go-sql-driver/mysql v1.4.1
 	github.com/jinzhu/gorm v1.9.12
 	github.com/labstack/echo/v4 v4.1.16
+	github.com/lib/pq v1.1.1
 	github.com/prometheus/client_golang v1.5.1
 	github.com/satori/go.uuid v1.2.0
 	github.com/sirupsen/logrus v1.5.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	golang.org/x/crypto v0.0.0-20200221231518-2aa609cf4a9d
 )
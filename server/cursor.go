@@ -0,0 +1,35 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/labstack/echo/v4"
+)
+
+// CursorPagination is the keyset counterpart of Pagination, Cursor is
+// empty for the first page.
+type CursorPagination struct {
+	Cursor string
+	Limit  uint
+}
+
+func GetEchoCursor(c echo.Context) CursorPagination {
+	p := CursorPagination{
+		Cursor: c.QueryParam("cursor"),
+		Limit:  uint(atoi(c.QueryParam("limit"), DefaultQuerySize)),
+	}
+	if p.Limit > MaxQuerySize {
+		p.Limit = MaxQuerySize
+	}
+	return p
+}
+
+func GetGinCursor(c gin.Context) CursorPagination {
+	p := CursorPagination{
+		Cursor: c.Query("cursor"),
+		Limit:  uint(atoi(c.Query("limit"), DefaultQuerySize)),
+	}
+	if p.Limit > MaxQuerySize {
+		p.Limit = MaxQuerySize
+	}
+	return p
+}
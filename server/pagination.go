@@ -39,13 +39,19 @@ func GetGinPagination(c gin.Context) Pagination {
 	return p
 }
 
+// Offset returns the number of rows before the page, page 0 is treated as
+// the first page.
 func (p *Pagination) Offset() uint {
+	if p.Page == 0 {
+		return 0
+	}
 	return (p.Page - 1) * p.Size
 }
 
+// atoi returns v when s is not a positive number.
 func atoi(s string, v int) int {
 	i, err := strconv.Atoi(s)
-	if err != nil {
+	if err != nil || i < 1 {
 		return v
 	}
 	return i